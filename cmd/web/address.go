@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// Addresses is a list of email addresses. It also decodes from a single
+// string, which is how queued messages stored the recipient before lists were
+// supported.
+type Addresses []string
+
+func (a *Addresses) UnmarshalJSON(b []byte) error {
+	var address string
+	if err := json.Unmarshal(b, &address); err == nil {
+		*a = nil
+		if address != "" {
+			*a = Addresses{address}
+		}
+		return nil
+	}
+
+	var addresses []string
+	if err := json.Unmarshal(b, &addresses); err != nil {
+		return err
+	}
+	*a = addresses
+	return nil
+}
+
+func (a Addresses) String() string {
+	return strings.Join(a, ", ")
+}
+
+func validateAddresses(header string, addresses ...string) error {
+	for _, address := range addresses {
+		if _, err := mail.ParseAddress(address); err != nil {
+			return fmt.Errorf("invalid %s address %q: %w", header, address, err)
+		}
+	}
+
+	return nil
+}
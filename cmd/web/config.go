@@ -3,8 +3,10 @@ package main
 import (
 	"database/sql"
 	"log"
+	"net/netip"
 	"simple-mailer-go/data"
 	"sync"
+	"time"
 
 	"github.com/alexedwards/scs/v2"
 )
@@ -17,6 +19,19 @@ type Config struct {
 	Wait      *sync.WaitGroup
 	Models    data.Models
 	Mailer    Mail
+	Templates *PageTemplates
+	Locales   *Locales
+	BaseURL   string
 	ErrorChan chan error
 	DoneChan  chan bool
+
+	// ActivationExpiry is how long an activation link works.
+	ActivationExpiry time.Duration
+	// ResetExpiry is how long a password reset link works.
+	ResetExpiry time.Duration
+	// TrustedProxies may tell which scheme and host a client used. Only
+	// BaseURL's host and AllowedHosts are taken from them.
+	TrustedProxies []netip.Prefix
+	AllowedHosts   []string
+	Signer         *URLSigner
 }
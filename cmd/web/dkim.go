@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/toorop/go-dkim"
+)
+
+// DKIMSettings configures DKIM signing for one sender domain.
+type DKIMSettings struct {
+	Domain         string   `yaml:"domain"`
+	Selector       string   `yaml:"selector"`
+	PrivateKeyPath string   `yaml:"private_key_path"`
+	Headers        []string `yaml:"headers"`
+}
+
+// DKIMKey signs outgoing mail for one sender domain.
+type DKIMKey struct {
+	Domain     string
+	Selector   string
+	PrivateKey []byte
+	Headers    []string
+}
+
+var defaultDKIMHeaders = []string{"from", "to", "cc", "reply-to", "subject", "date", "mime-version", "content-type"}
+
+// loadDKIMKey reads and checks the private key, so a bad key is reported at
+// startup instead of on the first send.
+func loadDKIMKey(s DKIMSettings) (DKIMKey, error) {
+	if s.Domain == "" || s.Selector == "" || s.PrivateKeyPath == "" {
+		return DKIMKey{}, errors.New("dkim needs a domain, a selector and a private key path")
+	}
+
+	content, err := os.ReadFile(s.PrivateKeyPath)
+	if err != nil {
+		return DKIMKey{}, fmt.Errorf("dkim key for %s: %w", s.Domain, err)
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return DKIMKey{}, fmt.Errorf("dkim key for %s is not PEM encoded", s.Domain)
+	}
+	if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return DKIMKey{}, fmt.Errorf("dkim key for %s: %w", s.Domain, err)
+		}
+		if _, ok := key.(*rsa.PrivateKey); !ok {
+			return DKIMKey{}, fmt.Errorf("dkim key for %s is not an RSA key", s.Domain)
+		}
+	}
+
+	headers := s.Headers
+	if len(headers) == 0 {
+		headers = defaultDKIMHeaders
+	}
+
+	return DKIMKey{
+		Domain:     strings.ToLower(s.Domain),
+		Selector:   s.Selector,
+		PrivateKey: content,
+		Headers:    headers,
+	}, nil
+}
+
+func (k DKIMKey) options() dkim.SigOptions {
+	options := dkim.NewSigOptions()
+	options.Domain = k.Domain
+	options.Selector = k.Selector
+	options.PrivateKey = k.PrivateKey
+	options.Canonicalization = "relaxed/relaxed"
+	// dkim.Sign lowercases the headers in place, so every signature gets
+	// its own copy
+	options.Headers = append([]string(nil), k.Headers...)
+
+	return options
+}
+
+// senderDomain returns the lowercased domain of a From address.
+func senderDomain(from string) string {
+	if addr, err := mail.ParseAddress(from); err == nil {
+		from = addr.Address
+	}
+
+	at := strings.LastIndex(from, "@")
+	if at < 0 {
+		return ""
+	}
+
+	return strings.ToLower(from[at+1:])
+}
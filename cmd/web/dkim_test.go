@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/toorop/go-dkim"
+)
+
+func TestMail_sendMail_dkim(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "dkim.pem")
+	_ = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	}), 0600)
+
+	key, err := loadDKIMKey(DKIMSettings{Domain: "example.com", Selector: "mail", PrivateKeyPath: keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := NewMemoryTransport()
+	m := Mail{
+		FromAddress: "info@example.com",
+		Templates:   testApp.Mailer.Templates,
+		DKIM:        map[string]DKIMKey{key.Domain: key},
+		Queue:       NewMemoryQueue(1),
+		Log:         testApp.Models.MailLog,
+	}
+	errorChan := make(chan error, 10)
+
+	m.sendMail(Message{To: []string{"me@here.com"}, Subject: "Signed", Data: "hello"}, transport, errorChan)
+
+	sent := transport.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("expected 1 sent message, got %d (errors: %d)", len(sent), len(errorChan))
+	}
+	if !strings.HasPrefix(sent[0].Raw, "DKIM-Signature:") {
+		t.Fatal("expected message to carry a DKIM signature")
+	}
+
+	publicKey, _ := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	lookup := func(name string) ([]string, error) {
+		if name != "mail._domainkey.example.com" {
+			t.Errorf("unexpected DNS lookup for %s", name)
+		}
+		return []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(publicKey)}, nil
+	}
+
+	raw := []byte(sent[0].Raw)
+	status, err := dkim.Verify(&raw, dkim.DNSOptLookupTXT(lookup))
+	if err != nil || status != dkim.SUCCESS {
+		t.Errorf("expected signature to verify, got status %v: %v", status, err)
+	}
+
+	tampered := []byte(strings.Replace(sent[0].Raw, "Subject: Signed", "Subject: Tampered", 1))
+	if status, _ = dkim.Verify(&tampered, dkim.DNSOptLookupTXT(lookup)); status == dkim.SUCCESS {
+		t.Error("expected a tampered message to fail verification")
+	}
+}
+
+func TestLoadDKIMKey_invalid(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "dkim.pem")
+	_ = os.WriteFile(keyPath, []byte("not a key"), 0600)
+
+	if _, err := loadDKIMKey(DKIMSettings{Domain: "example.com", Selector: "mail", PrivateKeyPath: keyPath}); err == nil {
+		t.Error("expected an invalid key to be rejected")
+	}
+	if _, err := loadDKIMKey(DKIMSettings{Domain: "example.com"}); err == nil {
+		t.Error("expected missing selector and key path to be rejected")
+	}
+}
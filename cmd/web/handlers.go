@@ -1,12 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io/fs"
 	"net/http"
+	"net/url"
+	"path"
 	"simple-mailer-go/data"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/phpdave11/gofpdf"
 	"github.com/phpdave11/gofpdf/contrib/gofpdi"
 )
@@ -43,9 +54,11 @@ func (app *Config) PostLoginPage(w http.ResponseWriter, r *http.Request) {
 	validPassword, err := app.Models.User.PasswordMatches(password)
 	if !validPassword {
 		msg := Message{
-			To:      email,
-			Subject: "Failed log in attempt",
-			Data:    "Invalid login attempt!",
+			UserID:   user.ID,
+			To:       []string{email},
+			Subject:  "Failed log in attempt",
+			Template: "failed-login",
+			Language: user.Language,
 		}
 
 		app.sendEmail(msg)
@@ -69,7 +82,11 @@ func (app *Config) Logout(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *Config) RegisterPage(w http.ResponseWriter, r *http.Request) {
-	app.render(w, r, "register.page.gohtml", nil)
+	app.render(w, r, "register.page.gohtml", &TemplateData{
+		Data: map[string]any{
+			"languages": app.Locales.Languages(),
+		},
+	})
 }
 
 func (app *Config) PostRegisterPage(w http.ResponseWriter, r *http.Request) {
@@ -85,36 +102,51 @@ func (app *Config) PostRegisterPage(w http.ResponseWriter, r *http.Request) {
 		Password:  r.Form.Get("password"),
 		Active:    0,
 		IsAdmin:   0,
+		Language:  app.Locales.Match(r.Form.Get("language"), app.translator(r).Language),
 	}
 
-	_, err = app.Models.User.Insert(u)
+	userID, err := app.Models.User.Insert(u)
 
 	if err != nil {
 		app.Session.Put(r.Context(), "error", "Failed to register user.")
 		http.Redirect(w, r, "/register", http.StatusSeeOther)
+		return
+	}
+
+	u.ID = userID
+	_ = app.sendActivationEmail(app.baseURL(r), u)
+
+	app.Session.Put(r.Context(), "flash", "Successful registration! Please check your email to activate your account.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// sendActivationEmail sends u a link under base to activate their account,
+// which works once within app.ActivationExpiry. Links sent earlier stop
+// working.
+func (app *Config) sendActivationEmail(base string, u data.User) error {
+	token, err := app.Models.Token.Issue(u.ID, data.TokenActivation, app.ActivationExpiry)
+	if err != nil {
+		app.ErrorLog.Println("failed to issue activation token:", err)
+		return err
 	}
 
-	url := fmt.Sprintf("http://localhost:3000/activate?email=%s", u.Email)
-	signedUrl := GenerateTokenFromString(url)
-	app.InfoLog.Println(signedUrl)
+	link := fmt.Sprintf("%s/activate?email=%s&token=%s", base, url.QueryEscape(u.Email), token)
+	signedUrl := app.Signer.Sign(link)
 
 	msg := Message{
-		To:       u.Email,
+		UserID:   u.ID,
+		To:       []string{u.Email},
 		Subject:  "Activate your account",
 		Template: "confirmation-email",
+		Language: u.Language,
 		Data:     template.HTML(signedUrl),
 	}
 
-	app.sendEmail(msg)
-
-	app.Session.Put(r.Context(), "flash", "Successful registration! Please check your email to activate your account.")
-	http.Redirect(w, r, "/login", http.StatusSeeOther)
+	return app.sendEmail(msg)
 }
 
 func (app *Config) ActivateAccount(w http.ResponseWriter, r *http.Request) {
-	url := r.RequestURI
-	testURL := fmt.Sprintf("http://localhost:3000%s", url)
-	ok := VerifyToken(testURL)
+	ok := app.Signer.Verify(r.RequestURI)
 
 	if !ok {
 		app.Session.Put(r.Context(), "error", "Invalid activation link.")
@@ -122,7 +154,27 @@ func (app *Config) ActivateAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u, err := app.Models.User.GetByEmail(r.URL.Query().Get("email"))
+	if app.Signer.Expired(r.RequestURI, app.ActivationExpiry) {
+		w.WriteHeader(http.StatusGone)
+		app.render(w, r, "activation-expired.page.gohtml", &TemplateData{
+			Data: map[string]any{
+				"email": r.URL.Query().Get("email"),
+			},
+		})
+		return
+	}
+
+	token, err := app.Models.Token.Consume(r.URL.Query().Get("token"), data.TokenActivation)
+	if err != nil {
+		if !errors.Is(err, data.ErrTokenInvalid) {
+			app.ErrorLog.Println(err)
+		}
+		app.Session.Put(r.Context(), "error", "This activation link is no longer valid.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	u, err := app.Models.User.GetOne(token.UserID)
 	if err != nil {
 		app.Session.Put(r.Context(), "error", "User not found.")
 		http.Redirect(w, r, "/", http.StatusNotFound)
@@ -140,6 +192,217 @@ func (app *Config) ActivateAccount(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
+// ResendActivation sends a fresh activation email from the link expired
+// page. The confirmation-email rate limit keeps the form from flooding an
+// inbox. The reply is the same whether or not the account exists or the
+// email was suppressed, which sendEmail logs, so the form does not tell
+// which addresses have an account.
+func (app *Config) ResendActivation(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	u, err := app.Models.User.GetByEmail(r.Form.Get("email"))
+	if err == nil && u.Active == 0 {
+		_ = app.sendActivationEmail(app.baseURL(r), *u)
+	}
+
+	app.Session.Put(r.Context(), "flash", "If the account is waiting to be activated, a new activation link is on its way.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func (app *Config) ForgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "forgot-password.page.gohtml", nil)
+}
+
+// PostForgotPasswordPage emails a link to reset the password. The reply is
+// the same whether or not the account exists or the email was suppressed by
+// the password-reset rate limit.
+func (app *Config) PostForgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	u, err := app.Models.User.GetByEmail(r.Form.Get("email"))
+	if err == nil {
+		_ = app.sendPasswordResetEmail(app.baseURL(r), *u)
+	}
+
+	app.Session.Put(r.Context(), "flash", "If an account uses that email address, a link to reset its password is on its way.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// sendPasswordResetEmail sends u a link under base to choose a new password,
+// which works once within app.ResetExpiry. Links sent earlier stop working.
+func (app *Config) sendPasswordResetEmail(base string, u data.User) error {
+	token, err := app.Models.Token.Issue(u.ID, data.TokenPasswordReset, app.ResetExpiry)
+	if err != nil {
+		app.ErrorLog.Println("failed to issue password reset token:", err)
+		return err
+	}
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", base, token)
+
+	msg := Message{
+		UserID:   u.ID,
+		To:       []string{u.Email},
+		Subject:  "Reset your password",
+		Template: "password-reset",
+		Language: u.Language,
+		Data:     template.HTML(app.Signer.Sign(link)),
+	}
+
+	return app.sendEmail(msg)
+}
+
+func (app *Config) ResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	if !app.checkResetLink(w, r) {
+		return
+	}
+
+	app.render(w, r, "reset-password.page.gohtml", &TemplateData{
+		Data: map[string]any{
+			"action": r.RequestURI,
+		},
+	})
+}
+
+// PostResetPasswordPage sets the new password, logs the user out
+// everywhere and tells them by email that the password changed.
+func (app *Config) PostResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	if !app.checkResetLink(w, r) {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	// check the form before using up the token, so a typo can be retried
+	password := r.Form.Get("password")
+	if password == "" || password != r.Form.Get("verify-password") {
+		app.Session.Put(r.Context(), "error", "Enter the same new password twice.")
+		http.Redirect(w, r, r.RequestURI, http.StatusSeeOther)
+		return
+	}
+
+	token, err := app.Models.Token.Consume(r.URL.Query().Get("token"), data.TokenPasswordReset)
+	if err != nil {
+		if !errors.Is(err, data.ErrTokenInvalid) {
+			app.ErrorLog.Println(err)
+		}
+		app.Session.Put(r.Context(), "error", "This password reset link is no longer valid.")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	u, err := app.Models.User.GetOne(token.UserID)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "User not found.")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	err = app.Models.User.ResetPassword(u.ID, password)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to reset password.")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	if err := app.logOutEverywhere(r.Context(), u.ID); err != nil {
+		app.ErrorLog.Println("failed to end sessions after password reset:", err)
+	}
+	_ = app.Session.Destroy(r.Context())
+	_ = app.Session.RenewToken(r.Context())
+
+	msg := Message{
+		UserID:   u.ID,
+		To:       []string{u.Email},
+		Subject:  "Your password was changed",
+		Template: "password-changed",
+		Language: u.Language,
+		Data:     template.HTML(app.baseURL(r) + "/forgot-password"),
+	}
+	app.sendEmail(msg)
+
+	app.Session.Put(r.Context(), "flash", "Your password was reset. Please login.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// checkResetLink verifies the signed password reset link the request came
+// through, and sends the user back to ask for a new one when it is not good.
+func (app *Config) checkResetLink(w http.ResponseWriter, r *http.Request) bool {
+	if !app.Signer.Verify(r.RequestURI) {
+		app.Session.Put(r.Context(), "error", "Invalid password reset link.")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return false
+	}
+
+	if app.Signer.Expired(r.RequestURI, app.ResetExpiry) {
+		app.Session.Put(r.Context(), "error", "This password reset link has expired. Please request a new one.")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return false
+	}
+
+	return true
+}
+
+// logOutEverywhere destroys every session of the user, so whoever knew the
+// old password is logged out too.
+func (app *Config) logOutEverywhere(ctx context.Context, userID int) error {
+	return app.Session.Iterate(ctx, func(ctx context.Context) error {
+		if app.Session.GetInt(ctx, "userID") != userID {
+			return nil
+		}
+		return app.Session.Destroy(ctx)
+	})
+}
+
+// TrackOpen records that a message was opened when a mail client loads its
+// tracking pixel. Only signed pixels are recorded, but the pixel is served
+// either way so a mail client never shows a broken image.
+func (app *Config) TrackOpen(w http.ResponseWriter, r *http.Request) {
+	if app.Signer.Verify(r.RequestURI) {
+		app.recordMailEvent(r, data.MailEventOpen, "")
+	}
+
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(trackingPixel)
+}
+
+// TrackClick records a click on a link in a message and redirects to the
+// link's address. The address is signed, so the endpoint cannot be used to
+// redirect anywhere else.
+func (app *Config) TrackClick(w http.ResponseWriter, r *http.Request) {
+	if !app.Signer.Verify(r.RequestURI) {
+		app.Session.Put(r.Context(), "error", "Invalid link.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	target := r.URL.Query().Get("url")
+	app.recordMailEvent(r, data.MailEventClick, target)
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+func (app *Config) recordMailEvent(r *http.Request, event, target string) {
+	_, err := app.Models.MailEvent.Insert(data.MailEvent{
+		MessageID: chi.URLParam(r, "id"),
+		Event:     event,
+		URL:       target,
+		UserAgent: r.UserAgent(),
+	})
+	if err != nil {
+		app.ErrorLog.Println("failed to record mail event:", err)
+	}
+}
+
 func (app *Config) ChooseSubscription(w http.ResponseWriter, r *http.Request) {
 	plans, err := app.Models.Plan.GetAll()
 	if err != nil {
@@ -181,10 +444,12 @@ func (app *Config) SubscribeToPlan(w http.ResponseWriter, r *http.Request) {
 		}
 
 		msg := Message{
-			To:       user.Email,
-			Subject:  "Your invoice plan",
+			UserID:   user.ID,
+			To:       []string{user.Email},
 			Data:     invoice,
+			DataMap:  map[string]any{"date": time.Now()},
 			Template: "invoice",
+			Language: user.Language,
 		}
 
 		app.sendEmail(msg)
@@ -193,18 +458,19 @@ func (app *Config) SubscribeToPlan(w http.ResponseWriter, r *http.Request) {
 	go func() {
 		defer app.Wait.Done()
 
-		pdf := app.generateManual(user, plan)
-		err := pdf.OutputFileAndClose(fmt.Sprintf("%s/%d_manual.pdf", tmpPath, user.ID))
-		if err != nil {
+		var manual bytes.Buffer
+		if err := app.generateManual(user, plan).Output(&manual); err != nil {
 			app.ErrorChan <- err
 			return
 		}
 		msg := Message{
-			To:      user.Email,
-			Subject: "Your manual",
-			Data:    "Your user manual is attached",
-			AttachmentMap: map[string]string{
-				"Manual.pdf": fmt.Sprintf("%s/%d_manual.pdf", tmpPath, user.ID),
+			UserID:   user.ID,
+			To:       []string{user.Email},
+			Subject:  "Your manual",
+			Data:     app.Locales.Translator(user.Language).T("Your user manual is attached"),
+			Language: user.Language,
+			Files: []Attachment{
+				{Name: "Manual.pdf", MimeType: "application/pdf", Data: manual.Bytes()},
 			},
 		}
 		app.sendEmail(msg)
@@ -227,8 +493,158 @@ func (app *Config) SubscribeToPlan(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
 }
 
+func (app *Config) DeadLetters(w http.ResponseWriter, r *http.Request) {
+	letters, err := app.Models.DeadLetter.GetAll()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	var messages []Message
+	for _, letter := range letters {
+		var msg Message
+		if err := json.Unmarshal(letter.Payload, &msg); err != nil {
+			app.ErrorLog.Println(err)
+		}
+		messages = append(messages, msg)
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["letters"] = letters
+	dataMap["messages"] = messages
+	app.render(w, r, "dead-letters.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// ReplayDeadLetter queues a dead letter again. It changes state, so it only
+// answers a POST with the id in the form.
+func (app *Config) ReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	id, _ := strconv.Atoi(r.PostForm.Get("id"))
+	letter, err := app.Models.DeadLetter.GetOne(id)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Unable to find message.")
+		http.Redirect(w, r, "/admin/mail/dead-letters", http.StatusSeeOther)
+		return
+	}
+
+	var msg Message
+	err = json.Unmarshal(letter.Payload, &msg)
+	if err == nil {
+		err = app.sendEmail(msg)
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to queue message.")
+		http.Redirect(w, r, "/admin/mail/dead-letters", http.StatusSeeOther)
+		return
+	}
+
+	err = app.Models.DeadLetter.DeleteByID(letter.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	app.Session.Put(r.Context(), "flash", "Message queued for delivery.")
+	http.Redirect(w, r, "/admin/mail/dead-letters", http.StatusSeeOther)
+}
+
+// PreviewMail renders an email template with the sample data in
+// templates/previews/<template>.json, in the language picked with ?lang=.
+func (app *Config) PreviewMail(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "template")
+
+	dataMap := make(map[string]any)
+	dataMap["templates"] = app.Mailer.Templates.Names()
+	dataMap["languages"] = app.Locales.Languages()
+	dataMap["template"] = name
+
+	if name != "" {
+		preview, err := app.previewMail(r, name)
+		if err != nil {
+			if !app.Mailer.Templates.Has(name) {
+				http.NotFound(w, r)
+				return
+			}
+			dataMap["problem"] = err.Error()
+		}
+		dataMap["preview"] = preview
+	}
+
+	app.render(w, r, "mail-preview.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+type mailPreview struct {
+	Subject string
+	HTML    string
+	Plain   string
+	Raw     string
+	Lint    LintResults
+}
+
+func (app *Config) previewMail(r *http.Request, name string) (*mailPreview, error) {
+	var msg Message
+
+	fixture, err := fs.ReadFile(app.Mailer.Templates.FS, path.Join("previews", name+".json"))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(fixture, &msg); err != nil {
+			return nil, fmt.Errorf("previews/%s.json: %w", name, err)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+
+	msg.ID = "preview"
+	msg.Template = name
+	// opening the preview is not opening the message
+	msg.NoTracking = true
+	msg.Language = app.translator(r).Language
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		msg.Language = app.Locales.Match(lang)
+	}
+	if len(msg.To) == 0 {
+		msg.To = []string{"preview@example.com"}
+		if user, ok := app.Session.Get(r.Context(), "user").(data.User); ok {
+			msg.To = []string{user.Email}
+		}
+	}
+
+	rendered, err := app.Mailer.render(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	email, err := app.Mailer.build(rendered)
+	if err != nil {
+		return nil, err
+	}
+
+	// a browser cannot resolve cid references, so the preview shows the
+	// images inline
+	html := rendered.HTML
+	for _, image := range rendered.Images {
+		html = strings.ReplaceAll(html, `"cid:`+image.Name+`"`, `"data:`+image.MimeType+`;base64,`+base64.StdEncoding.EncodeToString(image.Data)+`"`)
+	}
+
+	return &mailPreview{
+		Subject: rendered.Subject,
+		HTML:    html,
+		Plain:   rendered.Plain,
+		Raw:     rawMessage(email),
+		Lint:    lintMessage(rendered),
+	}, nil
+}
+
 func (app *Config) getInvoice(u data.User, plan *data.Plan) (string, error) {
-	return plan.PlanAmountFormatted, nil
+	return app.Locales.Translator(u.Language).Currency(plan.PlanAmount), nil
 }
 
 func (app *Config) generateManual(u data.User, plan *data.Plan) *gofpdf.Fpdf {
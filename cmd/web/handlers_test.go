@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"simple-mailer-go/data"
 	"strings"
 	"testing"
+	"time"
+
+	goalone "github.com/bwmarrin/go-alone"
+	"github.com/go-chi/chi/v5"
 )
 
 var pageTests = []struct {
@@ -31,6 +37,20 @@ var pageTests = []struct {
 		handler:      testApp.LoginPage,
 		expectHTML:   `<h1 class="mt-5">Login</h1>`,
 	},
+	{
+		name:         "forgot password",
+		url:          "/forgot-password",
+		expectedCode: http.StatusOK,
+		handler:      testApp.ForgotPasswordPage,
+		expectHTML:   `action="/forgot-password"`,
+	},
+	{
+		name:         "dead letters",
+		url:          "/admin/mail/dead-letters",
+		expectedCode: http.StatusOK,
+		handler:      testApp.DeadLetters,
+		expectHTML:   "dial tcp: connection refused",
+	},
 	{
 		name:         "logout",
 		url:          "/logout",
@@ -44,8 +64,6 @@ var pageTests = []struct {
 }
 
 func Test_Pages(t *testing.T) {
-	pathToTemplates = "./templates"
-
 	for _, e := range pageTests {
 		w := httptest.NewRecorder()
 
@@ -75,7 +93,6 @@ func Test_Pages(t *testing.T) {
 }
 
 func TestConfig_PostLoginPage(t *testing.T) {
-	pathToTemplates = "./templates"
 	postedData := url.Values{
 		"email":    {"admin@example.com"},
 		"password": {"password"},
@@ -98,13 +115,15 @@ func TestConfig_PostLoginPage(t *testing.T) {
 }
 
 func TestConfig_SubscribeToPlan(t *testing.T) {
+	testTransport.Reset()
+
 	w := httptest.NewRecorder()
 	r, _ := http.NewRequest("GET", "/members/subscribe?id=1", nil)
 	ctx := getCtx(r)
 	r = r.WithContext(ctx)
 	testApp.Session.Put(ctx, "user", data.User{
 		ID:        1,
-		Email:     "Admin",
+		Email:     "admin@example.com",
 		FirstName: "Admin",
 		LastName:  "test",
 		Active:    1,
@@ -117,4 +136,366 @@ func TestConfig_SubscribeToPlan(t *testing.T) {
 		t.Errorf("expected status code %d, got %d", http.StatusSeeOther, w.Code)
 	}
 
+	var invoice, manual bool
+	for _, sent := range waitForMail(t, 2) {
+		if strings.Contains(sent.Raw, "Subject: Your invoice plan") && strings.Contains(sent.Raw, "Your invoice: $10.00") {
+			invoice = true
+		}
+		if strings.Contains(sent.Raw, "Subject: Your manual") && strings.Contains(sent.Raw, `filename="Manual.pdf"`) {
+			manual = true
+		}
+	}
+	if !invoice {
+		t.Error("expected invoice email to be sent")
+	}
+	if !manual {
+		t.Error("expected manual email with attachment to be sent")
+	}
+}
+
+func TestConfig_ReplayDeadLetter(t *testing.T) {
+	testTransport.Reset()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/admin/mail/dead-letters/replay", strings.NewReader(url.Values{"id": {"1"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx := getCtx(r)
+	r = r.WithContext(ctx)
+
+	handler := http.HandlerFunc(testApp.ReplayDeadLetter)
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("expected status code %d, got %d", http.StatusSeeOther, w.Code)
+	}
+
+	if testApp.Session.GetString(ctx, "flash") != "Message queued for delivery." {
+		t.Error("expected dead letter to be queued again")
+	}
+
+	sent := waitForMail(t, 1)
+	if !strings.Contains(sent[0].Raw, "Subject: Your invoice plan") {
+		t.Error("expected replayed message to be delivered")
+	}
+}
+
+func TestConfig_PreviewMail(t *testing.T) {
+	tests := []struct {
+		url        string
+		template   string
+		code       int
+		expectHTML []string
+	}{
+		{"/admin/mail/preview", "", http.StatusOK, []string{"Pick a template to preview it.", "/admin/mail/preview/invoice"}},
+		{"/admin/mail/preview/invoice", "invoice", http.StatusOK, []string{"Your invoice: $10.00", "Message-Id: &lt;preview@", "Content-Type: text/plain", "data:image/png;base64,", "list-unsubscribe"}},
+		{"/admin/mail/preview/confirmation-email?lang=pt", "confirmation-email", http.StatusOK, []string{"Ative sua conta", "hash=preview"}},
+		{"/admin/mail/preview/failed-login", "failed-login", http.StatusOK, []string{"Someone tried to log in to your account"}},
+		{"/admin/mail/preview/nope", "nope", http.StatusNotFound, nil},
+	}
+
+	for _, e := range tests {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", e.url, nil)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("template", e.template)
+		ctx := context.WithValue(getCtx(r), chi.RouteCtxKey, rctx)
+		r = r.WithContext(ctx)
+
+		http.HandlerFunc(testApp.PreviewMail).ServeHTTP(w, r)
+
+		if w.Code != e.code {
+			t.Errorf("%s: expected status code %d, got %d", e.url, e.code, w.Code)
+		}
+		for _, want := range e.expectHTML {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("%s: expected page to contain %s", e.url, want)
+			}
+		}
+	}
+}
+
+func TestConfig_ActivateAccount(t *testing.T) {
+	link := "http://localhost:3000/activate?email=admin@example.com&token=test-token"
+	fresh := testApp.Signer.Sign(link)
+	// signing against a later epoch backdates the timestamp by two days
+	u, _ := url.Parse(link)
+	payload := canonicalURL(u)
+	backdated := goalone.New([]byte(testSigningKey.Secret), goalone.Timestamp, goalone.Epoch(48*60*60)).Sign([]byte(payload))
+	expired := payload + "&hash=" + url.QueryEscape(testSigningKey.ID+"."+string(backdated[len(payload)+1:]))
+	used := testApp.Signer.Sign(strings.Replace(link, "test-token", "used-token", 1))
+
+	tests := []struct {
+		name       string
+		url        string
+		code       int
+		expectHTML string
+		flash      string
+		error      string
+	}{
+		{"fresh", fresh, http.StatusSeeOther, "", "Successfully activated account. Please login.", ""},
+		{"expired", expired, http.StatusGone, "This activation link has expired", "", ""},
+		{"tampered", strings.Replace(fresh, "admin%40", "other%40", 1), http.StatusSeeOther, "", "", "Invalid activation link."},
+		{"used", used, http.StatusSeeOther, "", "", "This activation link is no longer valid."},
+	}
+
+	for _, e := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", strings.TrimPrefix(e.url, testApp.BaseURL), nil)
+		ctx := getCtx(r)
+		r = r.WithContext(ctx)
+
+		testApp.ActivateAccount(w, r)
+
+		if w.Code != e.code {
+			t.Errorf("%s: expected status code %d, got %d", e.name, e.code, w.Code)
+		}
+		if got := testApp.Session.GetString(ctx, "flash"); got != e.flash {
+			t.Errorf("%s: expected flash %q, got %q", e.name, e.flash, got)
+		}
+		if got := testApp.Session.GetString(ctx, "error"); got != e.error {
+			t.Errorf("%s: expected error %q, got %q", e.name, e.error, got)
+		}
+		if !strings.Contains(w.Body.String(), e.expectHTML) {
+			t.Errorf("%s: expected page to contain %s", e.name, e.expectHTML)
+		}
+	}
+}
+
+// failingUsers cannot store new users.
+type failingUsers struct {
+	data.UserTest
+}
+
+func (u *failingUsers) Insert(user data.User) (int, error) {
+	return 0, errors.New("duplicate email")
+}
+
+func TestConfig_PostRegisterPage_failed(t *testing.T) {
+	app := testApp
+	app.Models.User = &failingUsers{}
+
+	testTransport.Reset()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/register", strings.NewReader(url.Values{"email": {"me@here.com"}, "password": {"secret"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx := getCtx(r)
+	r = r.WithContext(ctx)
+
+	app.PostRegisterPage(w, r)
+
+	if got := w.Header().Get("Location"); got != "/register" {
+		t.Errorf("expected redirect back to /register, got %s", got)
+	}
+	if got := app.Session.GetString(ctx, "error"); got != "Failed to register user." {
+		t.Errorf("expected the registration error, got %q", got)
+	}
+	if got := app.Session.GetString(ctx, "flash"); got != "" {
+		t.Errorf("expected no success flash, got %q", got)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if sent := testTransport.Sent(); len(sent) != 0 {
+		t.Errorf("expected no activation email, got %d", len(sent))
+	}
+}
+
+// inactiveUsers returns users that still have to activate their account.
+type inactiveUsers struct {
+	data.UserTest
+}
+
+func (u *inactiveUsers) GetByEmail(email string) (*data.User, error) {
+	return &data.User{ID: 2, Email: email, Active: 0, Language: "en"}, nil
+}
+
+func TestConfig_rateLimitedReply(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		template string
+		email    string
+		users    data.UserInterface
+		handler  func(app *Config) http.HandlerFunc
+		flash    string
+		subject  string
+	}{
+		{
+			name:     "resend activation",
+			path:     "/activate/resend",
+			template: "confirmation-email",
+			email:    "new@here.com",
+			users:    &inactiveUsers{},
+			handler:  func(app *Config) http.HandlerFunc { return app.ResendActivation },
+			flash:    "If the account is waiting to be activated, a new activation link is on its way.",
+			subject:  "Activate your account",
+		},
+		{
+			name:     "forgot password",
+			path:     "/forgot-password",
+			template: "password-reset",
+			email:    "admin@test.com",
+			users:    testApp.Models.User,
+			handler:  func(app *Config) http.HandlerFunc { return app.PostForgotPasswordPage },
+			flash:    "If an account uses that email address, a link to reset its password is on its way.",
+			subject:  "Reset your password",
+		},
+	}
+
+	for _, e := range tests {
+		app := testApp
+		app.Models.User = e.users
+		app.Mailer.Limiter = &RateLimiter{PerTemplate: map[string]RateLimit{e.template: {Count: 1, Window: time.Hour}}}
+
+		// the second request is rate limited, but must look like the first so
+		// the form does not tell which addresses have an account
+		testTransport.Reset()
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", e.path, strings.NewReader(url.Values{"email": {e.email}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			ctx := getCtx(r)
+			r = r.WithContext(ctx)
+
+			e.handler(&app)(w, r)
+
+			if w.Code != http.StatusSeeOther {
+				t.Errorf("%s %d: expected status code %d, got %d", e.name, i, http.StatusSeeOther, w.Code)
+			}
+			if got := app.Session.GetString(ctx, "flash"); got != e.flash {
+				t.Errorf("%s %d: expected the generic reply, got %q", e.name, i, got)
+			}
+			if got := app.Session.GetString(ctx, "error"); got != "" {
+				t.Errorf("%s %d: expected no error, got %q", e.name, i, got)
+			}
+		}
+
+		sent := waitForMail(t, 1)
+		if len(sent) != 1 || sent[0].Recipients[0] != e.email || !strings.Contains(sent[0].Raw, "Subject: "+e.subject) {
+			t.Errorf("%s: expected one email", e.name)
+		}
+	}
+}
+
+func TestConfig_ResetPasswordPage(t *testing.T) {
+	link := testApp.Signer.Sign("http://localhost:3000/reset-password?token=test-token")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", strings.TrimPrefix(link, testApp.BaseURL), nil)
+	r = r.WithContext(getCtx(r))
+
+	testApp.ResetPasswordPage(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	// the form posts back to the signed link
+	if !strings.Contains(w.Body.String(), `action="/reset-password?token=test-token&amp;hash=`) {
+		t.Error("expected the form to post to the signed link")
+	}
+}
+
+func TestConfig_PostResetPasswordPage(t *testing.T) {
+	link := "http://localhost:3000/reset-password?token=test-token"
+	fresh := testApp.Signer.Sign(link)
+	u, _ := url.Parse(link)
+	payload := canonicalURL(u)
+	backdated := goalone.New([]byte(testSigningKey.Secret), goalone.Timestamp, goalone.Epoch(2*60*60)).Sign([]byte(payload))
+	expired := payload + "&hash=" + url.QueryEscape(testSigningKey.ID+"."+string(backdated[len(payload)+1:]))
+	used := testApp.Signer.Sign(strings.Replace(link, "test-token", "used-token", 1))
+
+	tests := []struct {
+		name     string
+		url      string
+		password string
+		verify   string
+		location string
+		flash    string
+		error    string
+	}{
+		{"reset", fresh, "new-password", "new-password", "/login", "Your password was reset. Please login.", ""},
+		{"mismatch", fresh, "new-password", "other-password", strings.TrimPrefix(fresh, testApp.BaseURL), "", "Enter the same new password twice."},
+		{"expired", expired, "new-password", "new-password", "/forgot-password", "", "This password reset link has expired. Please request a new one."},
+		{"tampered", strings.Replace(fresh, "test-token", "other-token", 1), "new-password", "new-password", "/forgot-password", "", "Invalid password reset link."},
+		{"used", used, "new-password", "new-password", "/forgot-password", "", "This password reset link is no longer valid."},
+	}
+
+	testTransport.Reset()
+	for _, e := range tests {
+		form := url.Values{"password": {e.password}, "verify-password": {e.verify}}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", strings.TrimPrefix(e.url, testApp.BaseURL), strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(r)
+		r = r.WithContext(ctx)
+
+		testApp.PostResetPasswordPage(w, r)
+
+		if w.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status code %d, got %d", e.name, http.StatusSeeOther, w.Code)
+		}
+		if got := w.Header().Get("Location"); got != e.location {
+			t.Errorf("%s: expected redirect to %s, got %s", e.name, e.location, got)
+		}
+		if got := testApp.Session.GetString(ctx, "flash"); got != e.flash {
+			t.Errorf("%s: expected flash %q, got %q", e.name, e.flash, got)
+		}
+		if got := testApp.Session.GetString(ctx, "error"); got != e.error {
+			t.Errorf("%s: expected error %q, got %q", e.name, e.error, got)
+		}
+	}
+
+	sent := waitForMail(t, 1)
+	if !strings.Contains(sent[0].Raw, "Subject: Your password was changed") {
+		t.Error("expected a password changed email")
+	}
+}
+
+func TestConfig_logOutEverywhere(t *testing.T) {
+	login := func(userID int) string {
+		ctx, _ := testApp.Session.Load(context.Background(), "")
+		testApp.Session.Put(ctx, "userID", userID)
+		token, _, err := testApp.Session.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	loggedIn := func(token string) bool {
+		ctx, _ := testApp.Session.Load(context.Background(), token)
+		return testApp.Session.Exists(ctx, "userID")
+	}
+
+	mine, theirs := login(1), login(2)
+
+	if err := testApp.logOutEverywhere(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if loggedIn(mine) {
+		t.Error("expected the user's session to be destroyed")
+	}
+	if !loggedIn(theirs) {
+		t.Error("expected other users to stay logged in")
+	}
+}
+
+func TestConfig_PostForgotPasswordPage_forwardedHost(t *testing.T) {
+	app := testApp
+	app.TrustedProxies, _ = parseTrustedProxies([]string{"192.0.2.1"})
+
+	testTransport.Reset()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/forgot-password", strings.NewReader(url.Values{"email": {"admin@test.com"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// a proxy that copies the client's Host header
+	r.Header.Set("X-Forwarded-Host", "evil.example")
+	r = r.WithContext(getCtx(r))
+
+	app.PostForgotPasswordPage(w, r)
+
+	sent := waitForMail(t, 1)
+	if strings.Contains(sent[0].Raw, "evil.example") || !strings.Contains(sent[0].Raw, "localhost:3000/reset-password") {
+		t.Error("expected the reset link to ignore a forwarded host that is not allowed")
+	}
 }
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed locales
+var embeddedLocales embed.FS
+
+const defaultLanguage = "en"
+
+// Catalog is the translation of the site into one language, loaded from
+// locales/<language>.json. Messages are keyed by their English text, so
+// anything missing from a catalog is shown in English.
+type Catalog struct {
+	Name               string            `json:"name"`
+	DateFormat         string            `json:"date_format"`
+	CurrencyFormat     string            `json:"currency_format"`
+	DecimalSeparator   string            `json:"decimal_separator"`
+	ThousandsSeparator string            `json:"thousands_separator"`
+	Messages           map[string]string `json:"messages"`
+}
+
+// Locales holds every catalog, keyed by language code.
+type Locales struct {
+	Default  string
+	catalogs map[string]*Catalog
+}
+
+func LoadLocales(fsys fs.FS, defaultLang string) (*Locales, error) {
+	files, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Locales{Default: defaultLang, catalogs: make(map[string]*Catalog)}
+	for _, file := range files {
+		b, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		var c Catalog
+		if err := json.Unmarshal(b, &c); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		l.catalogs[strings.TrimSuffix(path.Base(file), ".json")] = &c
+	}
+
+	if l.catalogs[defaultLang] == nil {
+		return nil, fmt.Errorf("no catalog for the default language %q", defaultLang)
+	}
+
+	return l, nil
+}
+
+func localesFS() fs.FS {
+	sub, err := fs.Sub(embeddedLocales, "locales")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+type Language struct {
+	Code string
+	Name string
+}
+
+// Languages lists the supported languages by code.
+func (l *Locales) Languages() []Language {
+	languages := make([]Language, 0, len(l.catalogs))
+	for code, c := range l.catalogs {
+		languages = append(languages, Language{Code: code, Name: c.Name})
+	}
+	sort.Slice(languages, func(i, j int) bool { return languages[i].Code < languages[j].Code })
+	return languages
+}
+
+// Match returns the first supported language out of tags, e.g. "pt" for
+// "pt-BR", or the default language.
+func (l *Locales) Match(tags ...string) string {
+	if l == nil {
+		return defaultLanguage
+	}
+
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if _, ok := l.catalogs[tag]; ok {
+			return tag
+		}
+		base, _, _ := strings.Cut(tag, "-")
+		if _, ok := l.catalogs[base]; ok {
+			return base
+		}
+	}
+
+	return l.Default
+}
+
+// MatchAcceptLanguage picks the language for an Accept-Language header.
+func (l *Locales) MatchAcceptLanguage(header string) string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		tags = append(tags, weighted{tag, q})
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	ordered := make([]string, len(tags))
+	for i, t := range tags {
+		ordered[i] = t.tag
+	}
+	return l.Match(ordered...)
+}
+
+// Translator returns a translator for lang, falling back to the default
+// language.
+func (l *Locales) Translator(lang string) *Translator {
+	if l == nil {
+		return &Translator{Language: defaultLanguage}
+	}
+
+	lang = l.Match(lang)
+	return &Translator{
+		Language: lang,
+		catalog:  l.catalogs[lang],
+		fallback: l.catalogs[l.Default],
+	}
+}
+
+// Translator formats text, dates and amounts for one language. The zero
+// value leaves everything in English.
+type Translator struct {
+	Language string
+
+	catalog  *Catalog
+	fallback *Catalog
+}
+
+// T translates message and formats args into it like fmt.Sprintf.
+func (t *Translator) T(message string, args ...any) string {
+	if translated, ok := t.lookup(func(c *Catalog) string { return c.Messages[message] }); ok {
+		message = translated
+	}
+
+	if len(args) > 0 {
+		return fmt.Sprintf(message, args...)
+	}
+	return message
+}
+
+// Date formats a time, or an RFC 3339 string as a time becomes after a trip
+// through the queue, in the language's date format.
+func (t *Translator) Date(v any) string {
+	var d time.Time
+	switch v := v.(type) {
+	case time.Time:
+		d = v
+	case string:
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return v
+		}
+		d = parsed
+	default:
+		return fmt.Sprint(v)
+	}
+
+	layout, ok := t.lookup(func(c *Catalog) string { return c.DateFormat })
+	if !ok {
+		layout = "January 2, 2006"
+	}
+	return d.Format(layout)
+}
+
+// Currency formats an amount in cents.
+func (t *Translator) Currency(cents int) string {
+	decimal, ok := t.lookup(func(c *Catalog) string { return c.DecimalSeparator })
+	if !ok {
+		decimal = "."
+	}
+	thousands, ok := t.lookup(func(c *Catalog) string { return c.ThousandsSeparator })
+	if !ok {
+		thousands = ","
+	}
+	format, ok := t.lookup(func(c *Catalog) string { return c.CurrencyFormat })
+	if !ok {
+		format = "$%s"
+	}
+
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+
+	units := strconv.Itoa(cents / 100)
+	var grouped strings.Builder
+	for i, digit := range units {
+		if i > 0 && (len(units)-i)%3 == 0 {
+			grouped.WriteString(thousands)
+		}
+		grouped.WriteRune(digit)
+	}
+
+	return sign + fmt.Sprintf(format, fmt.Sprintf("%s%s%02d", grouped.String(), decimal, cents%100))
+}
+
+func (t *Translator) lang() string {
+	if t.Language == "" {
+		return defaultLanguage
+	}
+	return t.Language
+}
+
+func (t *Translator) lookup(field func(*Catalog) string) (string, bool) {
+	for _, c := range []*Catalog{t.catalog, t.fallback} {
+		if c == nil {
+			continue
+		}
+		if v := field(c); v != "" {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Funcs returns the template helpers lang, t, date and currency.
+func (t *Translator) Funcs() template.FuncMap {
+	return template.FuncMap{
+		"lang":     t.lang,
+		"t":        t.T,
+		"date":     t.Date,
+		"currency": t.Currency,
+	}
+}
+
+// templateFuncs are registered while parsing so templates can refer to the
+// helpers. localize swaps the translation helpers for a translator's before
+// rendering.
+var templateFuncs = func() template.FuncMap {
+	funcs := (&Translator{}).Funcs()
+	funcs["cid"] = cid
+	return funcs
+}()
+
+// localize returns a copy of tmpl whose helpers translate with t.
+func localize(tmpl *template.Template, t *Translator) (*template.Template, error) {
+	clone, err := tmpl.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return clone.Funcs(t.Funcs()), nil
+}
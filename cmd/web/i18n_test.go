@@ -0,0 +1,170 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTranslator(t *testing.T) {
+	locales := testApp.Locales
+
+	en := locales.Translator("en")
+	pt := locales.Translator("pt-BR")
+
+	if pt.Language != "pt" {
+		t.Errorf("expected pt-BR to fall back to pt, got %s", pt.Language)
+	}
+	if got := locales.Translator("fr").Language; got != "en" {
+		t.Errorf("expected unsupported languages to use the default, got %s", got)
+	}
+
+	if got := en.T("Activate your account"); got != "Activate your account" {
+		t.Errorf("unexpected english text %q", got)
+	}
+	if got := pt.T("Activate your account"); got != "Ative sua conta" {
+		t.Errorf("unexpected portuguese text %q", got)
+	}
+	if got := pt.T("Your invoice: %s", "US$ 10,00"); got != "Sua fatura: US$ 10,00" {
+		t.Errorf("unexpected formatted text %q", got)
+	}
+	if got := pt.T("Not translated"); got != "Not translated" {
+		t.Errorf("expected missing messages to stay in english, got %q", got)
+	}
+
+	if got := en.Currency(123456); got != "$1,234.56" {
+		t.Errorf("unexpected english amount %q", got)
+	}
+	if got := pt.Currency(1000); got != "US$ 10,00" {
+		t.Errorf("unexpected portuguese amount %q", got)
+	}
+	if got := en.Currency(-5); got != "-$0.05" {
+		t.Errorf("unexpected negative amount %q", got)
+	}
+
+	d := time.Date(2022, time.May, 12, 0, 0, 0, 0, time.UTC)
+	if got := en.Date(d); got != "May 12, 2022" {
+		t.Errorf("unexpected english date %q", got)
+	}
+	if got := pt.Date(d.Format(time.RFC3339)); got != "12/05/2022" {
+		t.Errorf("unexpected portuguese date %q", got)
+	}
+
+	var zero *Locales
+	if got := zero.Translator("pt").Currency(1000); got != "$10.00" {
+		t.Errorf("expected the zero translator to format in english, got %q", got)
+	}
+}
+
+func TestLocales_MatchAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{"", "en"},
+		{"pt-BR,pt;q=0.9,en;q=0.8", "pt"},
+		{"fr-CA,fr;q=0.9", "en"},
+		{"en;q=0.5, pt;q=0.8", "pt"},
+		{"de, en-GB;q=0.7", "en"},
+	}
+
+	for _, e := range tests {
+		if got := testApp.Locales.MatchAcceptLanguage(e.header); got != e.expected {
+			t.Errorf("%q: expected %s, got %s", e.header, e.expected, got)
+		}
+	}
+}
+
+// Every string the templates and handlers translate should be in each
+// catalog, or it silently shows up in English.
+func TestLocales_complete(t *testing.T) {
+	patterns := map[string]*regexp.Regexp{
+		"templates/*.gohtml":    regexp.MustCompile(`\{\{t "([^"]+)"`),
+		"templates/*.md.gohtml": regexp.MustCompile(`(?m)^(?:subject|preheader): (.+)$`),
+		"*.go":                  regexp.MustCompile(`(?:Session\.Put\(r\.Context\(\), "(?:flash|error|warning)", |Subject:\s+|\.T\()"([^"]+)"`),
+	}
+
+	messages := make(map[string]bool)
+	for glob, re := range patterns {
+		files, _ := filepath.Glob(glob)
+		for _, file := range files {
+			if strings.HasSuffix(file, "_test.go") {
+				continue
+			}
+			source, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, match := range re.FindAllStringSubmatch(string(source), -1) {
+				messages[match[1]] = true
+			}
+		}
+	}
+	if len(messages) == 0 {
+		t.Fatal("no messages found")
+	}
+
+	for _, lang := range testApp.Locales.Languages() {
+		if lang.Code == testApp.Locales.Default {
+			continue
+		}
+		catalog := testApp.Locales.catalogs[lang.Code]
+		for message := range messages {
+			if _, ok := catalog.Messages[message]; !ok {
+				t.Errorf("%s: missing translation for %q", lang.Code, message)
+			}
+		}
+	}
+}
+
+func TestConfig_Render_language(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	r, _ := http.NewRequest("GET", "/login", nil)
+	r.Header.Set("Accept-Language", "pt-BR,pt;q=0.9")
+	ctx := getCtx(r)
+	r = r.WithContext(ctx)
+
+	testApp.render(w, r, "login.page.gohtml", &TemplateData{})
+
+	body := w.Body.String()
+	if !strings.Contains(body, `<html lang="pt">`) || !strings.Contains(body, "Endereço de email") {
+		t.Error("expected the login page in portuguese")
+	}
+}
+
+func TestMail_sendMail_language(t *testing.T) {
+	testTransport.Reset()
+
+	testApp.sendEmail(Message{
+		To:       []string{"eu@aqui.com"},
+		Subject:  "Activate your account",
+		Template: "confirmation-email",
+		Language: "pt",
+		Data:     "http://localhost/activate?email=eu@aqui.com",
+	})
+
+	sent := waitForMail(t, 1)
+	msg, err := netmail.ReadMessage(strings.NewReader(sent[0].Raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Ative sua conta" {
+		t.Errorf("expected a portuguese subject, got %q", subject)
+	}
+	if !strings.Contains(sent[0].Raw, `lang=3D"pt"`) {
+		t.Error("expected the portuguese template")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// gmailClipSize is the size of HTML past which Gmail clips a message and
+// hides the rest behind a link.
+const gmailClipSize = 102 * 1024
+
+type LintSeverity string
+
+const (
+	LintWarning LintSeverity = "warning"
+	LintError   LintSeverity = "error"
+)
+
+// LintResult is one problem found in a rendered message. Check names the
+// rule that found it, e.g. "broken-link".
+type LintResult struct {
+	Severity LintSeverity
+	Check    string
+	Message  string
+}
+
+func (r LintResult) String() string {
+	return fmt.Sprintf("%s: %s: %s", r.Severity, r.Check, r.Message)
+}
+
+type LintResults []LintResult
+
+// Warnings returns the results that do not stop a message from being sent.
+func (results LintResults) Warnings() LintResults {
+	var warnings LintResults
+	for _, r := range results {
+		if r.Severity == LintWarning {
+			warnings = append(warnings, r)
+		}
+	}
+	return warnings
+}
+
+// Err joins the errors in results, or returns nil when there are none.
+func (results LintResults) Err() error {
+	var errs []error
+	for _, r := range results {
+		if r.Severity == LintError {
+			errs = append(errs, errors.New(r.String()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// lintMessage checks a rendered message for what makes mail look broken or
+// like spam: links that go nowhere, images without alt text, HTML big enough
+// to be clipped, a missing plain text part, remote @import rules and a
+// missing List-Unsubscribe header.
+func lintMessage(msg renderedMessage) LintResults {
+	var results LintResults
+	add := func(severity LintSeverity, check, format string, args ...any) {
+		results = append(results, LintResult{Severity: severity, Check: check, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if strings.TrimSpace(msg.Plain) == "" {
+		add(LintError, "plain-text", "the message has no plain text part")
+	}
+
+	if len(msg.HTML) > gmailClipSize {
+		add(LintError, "size", "the HTML is %d KB, Gmail clips messages over %d KB", len(msg.HTML)/1024, gmailClipSize/1024)
+	}
+
+	if msg.unsubscribeURL() == "" {
+		add(LintWarning, "list-unsubscribe", "the message has no List-Unsubscribe header")
+	}
+
+	z := html.NewTokenizer(strings.NewReader(msg.HTML))
+	inStyle := false
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if err := z.Err(); err != io.EOF {
+				add(LintError, "html", "the HTML does not parse: %s", err)
+			}
+			break
+		}
+
+		token := z.Token()
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			switch token.Data {
+			case "a":
+				if href, ok := attr(token, "href"); ok {
+					if problem := brokenLink(href); problem != "" {
+						add(LintError, "broken-link", "link %q %s", href, problem)
+					}
+				}
+			case "img":
+				src, _ := attr(token, "src")
+				if problem := brokenLink(src); problem != "" {
+					add(LintError, "broken-link", "image %q %s", src, problem)
+				}
+				if _, ok := attr(token, "alt"); !ok {
+					add(LintWarning, "alt-text", "image %q has no alt text", src)
+				}
+			case "style":
+				inStyle = tt == html.StartTagToken
+			}
+		case html.EndTagToken:
+			if token.Data == "style" {
+				inStyle = false
+			}
+		case html.TextToken:
+			if inStyle && strings.Contains(token.Data, "@import") {
+				add(LintWarning, "import", "@import in a style sheet is blocked by most mail clients, so its fonts or styles are lost")
+			}
+		}
+	}
+
+	return results
+}
+
+// brokenLink says what is wrong with a link's address, or returns "" when
+// it can be followed from a mail client.
+func brokenLink(ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || ref == "#" {
+		return "is empty"
+	}
+
+	lower := strings.ToLower(ref)
+	if strings.Contains(lower, "no value>") || strings.Contains(lower, "no%20value%3e") || strings.Contains(lower, "zgotmplz") {
+		return "was not filled in by the template"
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "does not parse"
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" {
+			return "has no host"
+		}
+	case "mailto", "tel", "cid", "data":
+	case "":
+		return "is relative, which mail clients cannot resolve"
+	default:
+		return fmt.Sprintf("uses the unsupported scheme %s", u.Scheme)
+	}
+	return ""
+}
+
+func attr(token html.Token, name string) (string, bool) {
+	for _, a := range token.Attr {
+		if a.Key == name {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
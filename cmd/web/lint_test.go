@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"simple-mailer-go/data"
+	"strings"
+	"testing"
+)
+
+func TestLintMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      renderedMessage
+		expected []string
+	}{
+		{
+			"clean",
+			renderedMessage{
+				Message: Message{DataMap: map[string]any{"unsubscribe": "https://example.com/unsubscribe"}},
+				HTML:    `<a href="https://example.com">Go</a><img src="cid:logo.png" alt="Logo"><a href="mailto:me@here.com">Mail</a>`,
+				Plain:   "Go",
+			},
+			nil,
+		},
+		{
+			"everything wrong",
+			renderedMessage{
+				HTML: `<style>@import url('https://fonts.example.com/font.css');</style>` +
+					`<a href="">Empty</a><a href="/activate">Relative</a><a href="%3cno%20value%3e">Missing</a>` +
+					`<a href="javascript:alert(1)">Script</a><img src="https://example.com/logo.png">` +
+					strings.Repeat(" ", gmailClipSize),
+			},
+			[]string{
+				"error: plain-text: the message has no plain text part",
+				"error: size: the HTML is 102 KB, Gmail clips messages over 102 KB",
+				"warning: list-unsubscribe: the message has no List-Unsubscribe header",
+				"warning: import: @import in a style sheet",
+				`error: broken-link: link "" is empty`,
+				`error: broken-link: link "/activate" is relative`,
+				`error: broken-link: link "%3cno%20value%3e" was not filled in by the template`,
+				`error: broken-link: link "javascript:alert(1)" uses the unsupported scheme javascript`,
+				`warning: alt-text: image "https://example.com/logo.png" has no alt text`,
+			},
+		},
+	}
+
+	for _, e := range tests {
+		results := lintMessage(e.msg)
+		if len(results) != len(e.expected) {
+			t.Errorf("%s: expected %d results, got %v", e.name, len(e.expected), results)
+			continue
+		}
+		for i, want := range e.expected {
+			if !strings.HasPrefix(results[i].String(), want) {
+				t.Errorf("%s: expected %s, got %s", e.name, want, results[i])
+			}
+		}
+	}
+}
+
+func TestLintMessage_templates(t *testing.T) {
+	for _, name := range testApp.Mailer.Templates.Names() {
+		msg := Message{To: []string{"me@here.com"}}
+		if fixture, err := fs.ReadFile(testApp.Mailer.Templates.FS, "previews/"+name+".json"); err == nil {
+			if err := json.Unmarshal(fixture, &msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		msg.Template = name
+
+		rendered, err := testApp.Mailer.render(msg)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if err := lintMessage(rendered).Err(); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+}
+
+func TestMail_sendMail_lint(t *testing.T) {
+	recorder := &statusRecorder{}
+	m := Mail{
+		FromAddress: "info@localhost",
+		Templates:   testApp.Mailer.Templates,
+		Queue:       NewMemoryQueue(1),
+		RetryPolicy: RetryPolicy{MaxAttempts: 1},
+		DeadLetters: testApp.Models.DeadLetter,
+		Log:         recorder,
+		InfoLog:     testApp.InfoLog,
+		Lint:        true,
+	}
+	errorChan := make(chan error, 10)
+
+	m.sendMail(Message{ID: "1", To: []string{"me@here.com"}, Template: "confirmation-email", Data: "/activate"}, NewMemoryTransport(), errorChan)
+
+	if len(recorder.statuses) != 1 || recorder.statuses[0] != data.MailStatusFailed {
+		t.Errorf("expected a message with a broken link to fail, got %v", recorder.statuses)
+	}
+	if err := <-errorChan; !strings.Contains(err.Error(), `link "/activate" is relative`) {
+		t.Errorf("expected the lint error to be reported, got %s", err)
+	}
+}
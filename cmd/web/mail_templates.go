@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+)
+
+// The layouts every email is rendered in. The HTML layout is parsed with the
+// email-*.partial.gohtml files and both fill their body block with the
+// template's body, or with the content rendered from Markdown. The plain text
+// layout and bodies are text templates, so links and names are not HTML
+// escaped.
+const (
+	emailLayout      = "email.layout.gohtml"
+	emailPlainLayout = "email-plain.layout.gohtml"
+)
+
+// imagesDir holds the images every email can embed, like the logo.
+const imagesDir = "images"
+
+// MailTemplate is one email template. It is either a pair of
+// <name>.html.gohtml and <name>.plain.gohtml files defining a body, or a
+// single <name>.md.gohtml Markdown file with optional front matter that both
+// parts are rendered from.
+type MailTemplate struct {
+	Name      string
+	Subject   string
+	Preheader string
+	// NoTracking leaves messages from the template out of open and click
+	// tracking. A Markdown template sets tracking: false in its front
+	// matter, an HTML one defines an empty no-tracking template.
+	NoTracking bool
+
+	html     *template.Template
+	plain    *texttemplate.Template
+	markdown *template.Template
+}
+
+// MailTemplates holds the parsed email templates, keyed by name.
+type MailTemplates struct {
+	FS fs.FS
+	// Reload parses the templates again when a file in FS has changed.
+	Reload bool
+
+	mu        sync.RWMutex
+	loaded    time.Time
+	templates map[string]*MailTemplate
+}
+
+func NewMailTemplates(fsys fs.FS, reload bool) (*MailTemplates, error) {
+	t := &MailTemplates{FS: fsys, Reload: reload}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *MailTemplates) load() error {
+	loaded := time.Now()
+
+	partials, err := fs.Glob(t.FS, "email-*.partial.gohtml")
+	if err != nil {
+		return err
+	}
+
+	layout, err := t.parseLayout("email", append([]string{emailLayout}, partials...)...)
+	if err != nil {
+		return err
+	}
+
+	plainLayout, err := t.parsePlainLayout("email-plain", emailPlainLayout)
+	if err != nil {
+		return err
+	}
+
+	html, err := t.parse(layout, ".html.gohtml")
+	if err != nil {
+		return err
+	}
+
+	plain, err := t.parsePlain(plainLayout, ".plain.gohtml")
+	if err != nil {
+		return err
+	}
+
+	templates, err := t.parseMarkdown()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, name := range sortedNames(html) {
+		if plain[name] == nil {
+			errs = append(errs, fmt.Errorf("email template %q has no plain text variant", name))
+		}
+	}
+	for _, name := range sortedNames(plain) {
+		if html[name] == nil {
+			errs = append(errs, fmt.Errorf("email template %q has no HTML variant", name))
+		}
+	}
+	for _, name := range sortedNames(html) {
+		if templates[name] != nil {
+			errs = append(errs, fmt.Errorf("email template %q is both Markdown and HTML", name))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	for _, tmpl := range templates {
+		if tmpl.html, err = layout.Clone(); err != nil {
+			return err
+		}
+		if tmpl.plain, err = plainLayout.Clone(); err != nil {
+			return err
+		}
+	}
+	for name := range html {
+		templates[name] = &MailTemplate{
+			Name:       name,
+			NoTracking: html[name].Lookup("no-tracking") != nil,
+			html:       html[name],
+			plain:      plain[name],
+		}
+	}
+
+	t.mu.Lock()
+	t.loaded, t.templates = loaded, templates
+	t.mu.Unlock()
+
+	return nil
+}
+
+// parseLayout parses files and checks that they define the named layout.
+func (t *MailTemplates) parseLayout(name string, files ...string) (*template.Template, error) {
+	layout, err := template.New(files[0]).Funcs(templateFuncs).ParseFS(t.FS, files...)
+	if err != nil {
+		return nil, err
+	}
+	if layout.Lookup(name) == nil {
+		return nil, fmt.Errorf("email layout %s does not define %s", files[0], name)
+	}
+	return layout, nil
+}
+
+// parsePlainLayout is parseLayout for the plain text layout.
+func (t *MailTemplates) parsePlainLayout(name string, files ...string) (*texttemplate.Template, error) {
+	layout, err := texttemplate.New(files[0]).Funcs(templateFuncs).ParseFS(t.FS, files...)
+	if err != nil {
+		return nil, err
+	}
+	if layout.Lookup(name) == nil {
+		return nil, fmt.Errorf("email layout %s does not define %s", files[0], name)
+	}
+	return layout, nil
+}
+
+// parse parses every file ending in suffix into its own copy of layout.
+func (t *MailTemplates) parse(layout *template.Template, suffix string) (map[string]*template.Template, error) {
+	bodies, err := t.bodies(suffix)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make(map[string]*template.Template)
+	for name, body := range bodies {
+		tmpl, err := layout.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tmpl.New(name).Parse(body); err != nil {
+			return nil, fmt.Errorf("%s%s: %w", name, suffix, err)
+		}
+		templates[name] = tmpl
+	}
+
+	return templates, nil
+}
+
+// parsePlain is parse for the plain text bodies.
+func (t *MailTemplates) parsePlain(layout *texttemplate.Template, suffix string) (map[string]*texttemplate.Template, error) {
+	bodies, err := t.bodies(suffix)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make(map[string]*texttemplate.Template)
+	for name, body := range bodies {
+		tmpl, err := layout.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tmpl.New(name).Parse(body); err != nil {
+			return nil, fmt.Errorf("%s%s: %w", name, suffix, err)
+		}
+		templates[name] = tmpl
+	}
+
+	return templates, nil
+}
+
+// bodies reads every file ending in suffix, keyed by template name.
+func (t *MailTemplates) bodies(suffix string) (map[string]string, error) {
+	files, err := fs.Glob(t.FS, "*"+suffix)
+	if err != nil {
+		return nil, err
+	}
+
+	bodies := make(map[string]string)
+	for _, file := range files {
+		name := strings.TrimSuffix(file, suffix)
+
+		body, err := fs.ReadFile(t.FS, file)
+		if err != nil {
+			return nil, err
+		}
+
+		// a body template that defines nothing leaves the layout's body
+		// block in place, so look for it before composing
+		check, err := texttemplate.New(name).Funcs(templateFuncs).Parse(string(body))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if check.Lookup("body") == nil {
+			return nil, fmt.Errorf("email template %s does not define a body", file)
+		}
+
+		bodies[name] = string(body)
+	}
+
+	return bodies, nil
+}
+
+func (t *MailTemplates) parseMarkdown() (map[string]*MailTemplate, error) {
+	files, err := fs.Glob(t.FS, "*.md.gohtml")
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make(map[string]*MailTemplate)
+	for _, file := range files {
+		src, err := fs.ReadFile(t.FS, file)
+		if err != nil {
+			return nil, err
+		}
+
+		fm, body, err := splitFrontMatter(src)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		name := strings.TrimSuffix(file, ".md.gohtml")
+		tmpl, err := template.New(name).Funcs(templateFuncs).Parse(string(body))
+		if err != nil {
+			return nil, err
+		}
+
+		templates[name] = &MailTemplate{
+			Name:       name,
+			Subject:    fm.Subject,
+			Preheader:  fm.Preheader,
+			NoTracking: fm.Tracking != nil && !*fm.Tracking,
+			markdown:   tmpl,
+		}
+	}
+
+	return templates, nil
+}
+
+// HTML renders the HTML part of the named template, before CSS is inlined.
+func (t *MailTemplates) HTML(name string, tr *Translator, data map[string]any) (string, error) {
+	tmpl, err := t.lookup(name)
+	if err != nil {
+		return "", err
+	}
+
+	layoutData := tmpl.layoutData(tr, data)
+	if tmpl.markdown != nil {
+		md, err := execute(tmpl.markdown, name, tr, data)
+		if err != nil {
+			return "", err
+		}
+
+		content, err := markdownToHTML(md)
+		if err != nil {
+			return "", err
+		}
+		layoutData["content"] = template.HTML(content)
+	}
+
+	return execute(tmpl.html, "email", tr, layoutData)
+}
+
+// Plain renders the plain text part of the named template.
+func (t *MailTemplates) Plain(name string, tr *Translator, data map[string]any) (string, error) {
+	tmpl, err := t.lookup(name)
+	if err != nil {
+		return "", err
+	}
+
+	layoutData := tmpl.layoutData(tr, data)
+	if tmpl.markdown != nil {
+		md, err := execute(tmpl.markdown, name, tr, data)
+		if err != nil {
+			return "", err
+		}
+
+		// already plain text, so it must not be escaped again
+		layoutData["content"] = template.HTML(markdownToText(md))
+	}
+
+	return executePlain(tmpl.plain, "email-plain", tr, layoutData)
+}
+
+// layoutData adds what the layouts need to the message data: the subject,
+// unless the sender already set one, the preheader and the year.
+func (tmpl *MailTemplate) layoutData(tr *Translator, data map[string]any) map[string]any {
+	layoutData := make(map[string]any, len(data)+3)
+	for k, v := range data {
+		layoutData[k] = v
+	}
+
+	if _, ok := layoutData["subject"]; !ok {
+		layoutData["subject"] = tr.T(tmpl.Subject)
+	}
+	layoutData["preheader"] = tr.T(tmpl.Preheader)
+	layoutData["year"] = time.Now().Year()
+
+	return layoutData
+}
+
+// Subject returns the subject from the named template's front matter, if any.
+func (t *MailTemplates) Subject(name string) string {
+	tmpl, err := t.lookup(name)
+	if err != nil {
+		return ""
+	}
+	return tmpl.Subject
+}
+
+func (t *MailTemplates) lookup(name string) (*MailTemplate, error) {
+	if t.Reload {
+		t.mu.RLock()
+		loaded := t.loaded
+		t.mu.RUnlock()
+
+		if changed, err := modifiedSince(t.FS, loaded); err != nil || changed {
+			if err := t.load(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	tmpl, ok := t.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown email template %q", name)
+	}
+	return tmpl, nil
+}
+
+// Tracked reports whether messages from the named template may be tracked.
+func (t *MailTemplates) Tracked(name string) bool {
+	tmpl, err := t.lookup(name)
+	if err != nil {
+		return false
+	}
+	return !tmpl.NoTracking
+}
+
+// Has reports whether the named template is registered.
+func (t *MailTemplates) Has(name string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	_, ok := t.templates[name]
+	return ok
+}
+
+// Names lists the available templates.
+func (t *MailTemplates) Names() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	names := make([]string, 0, len(t.templates))
+	for name := range t.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Image reads one of the images in imagesDir.
+func (t *MailTemplates) Image(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, fmt.Errorf("invalid image name %q", name)
+	}
+	return fs.ReadFile(t.FS, path.Join(imagesDir, name))
+}
+
+// cid refers to an image embedded in the email, as in
+// <img src="{{cid "logo.png"}}">. The image is attached when the message is
+// composed.
+func cid(name string) template.URL {
+	return template.URL("cid:" + name)
+}
+
+// execute renders the named template in tmpl with tr's translations.
+func execute(tmpl *template.Template, name string, tr *Translator, data any) (string, error) {
+	tmpl, err := localize(tmpl, tr)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&b, name, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// executePlain is execute for a plain text template.
+func executePlain(tmpl *texttemplate.Template, name string, tr *Translator, data any) (string, error) {
+	tmpl, err := tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Funcs(tr.Funcs()).ExecuteTemplate(&b, name, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func sortedNames[T any](templates map[string]T) []string {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
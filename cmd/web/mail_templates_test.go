@@ -0,0 +1,200 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestNewMailTemplates(t *testing.T) {
+	templates, err := NewMailTemplates(templatesFS(false), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := testApp.Locales.Translator("en")
+	data := map[string]any{"message": "hello"}
+	for _, name := range []string{"mail", "confirmation-email", "invoice", "failed-login"} {
+		if _, err := templates.HTML(name, tr, data); err != nil {
+			t.Errorf("html: %s", err)
+		}
+		if _, err := templates.Plain(name, tr, data); err != nil {
+			t.Errorf("plain: %s", err)
+		}
+	}
+
+	if _, err := templates.HTML("nope", tr, data); err == nil {
+		t.Error("expected an error for an unknown template")
+	}
+}
+
+// layoutFS returns minimal email layouts along with files.
+func layoutFS(files fstest.MapFS) fstest.MapFS {
+	fsys := fstest.MapFS{
+		emailLayout:                   {Data: []byte(`{{define "email"}}<title>{{.subject}}</title>{{block "body" .}}{{.content}}{{end}}{{template "email-footer" .}}{{end}}`)},
+		"email-footer.partial.gohtml": {Data: []byte(`{{define "email-footer"}}<footer>{{.year}}</footer>{{end}}`)},
+		emailPlainLayout:              {Data: []byte(`{{define "email-plain"}}{{block "body" .}}{{.content}}{{end}}-- {{.year}}{{end}}`)},
+	}
+	for name, file := range files {
+		fsys[name] = file
+	}
+	return fsys
+}
+
+func TestNewMailTemplates_missingVariant(t *testing.T) {
+	fsys := layoutFS(fstest.MapFS{
+		"welcome.html.gohtml":  {Data: []byte(`{{define "body"}}<p>Hi</p>{{end}}`)},
+		"goodbye.plain.gohtml": {Data: []byte(`{{define "body"}}Bye{{end}}`)},
+		"home.page.gohtml":     {Data: []byte(`{{template "base" .}}`)},
+	})
+
+	_, err := NewMailTemplates(fsys, false)
+	if err == nil {
+		t.Fatal("expected an error for templates without both variants")
+	}
+	for _, want := range []string{`"welcome" has no plain text variant`, `"goodbye" has no HTML variant`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %s, got %s", want, err)
+		}
+	}
+}
+
+func TestMailTemplates_layout(t *testing.T) {
+	fsys := layoutFS(fstest.MapFS{
+		"welcome.html.gohtml":  {Data: []byte(`{{define "body"}}<p>Hi {{.name}}</p>{{end}}`)},
+		"welcome.plain.gohtml": {Data: []byte(`{{define "body"}}Hi {{.name}}{{end}}`)},
+		"empty.html.gohtml":    {Data: []byte(`<p>No body</p>`)},
+		"empty.plain.gohtml":   {Data: []byte(`{{define "body"}}{{end}}`)},
+	})
+
+	_, err := NewMailTemplates(fsys, false)
+	if err == nil || !strings.Contains(err.Error(), "empty.html.gohtml does not define a body") {
+		t.Errorf("expected an error for the template without a body, got %v", err)
+	}
+
+	delete(fsys, "empty.html.gohtml")
+	delete(fsys, "empty.plain.gohtml")
+	templates, err := NewMailTemplates(fsys, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	year := strconv.Itoa(time.Now().Year())
+	data := map[string]any{"name": "Tom", "subject": "Welcome"}
+
+	html, err := templates.HTML("welcome", &Translator{}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "<title>Welcome</title><p>Hi Tom</p><footer>" + year + "</footer>"; html != expected {
+		t.Errorf("expected %q, got %q", expected, html)
+	}
+
+	plain, err := templates.Plain("welcome", &Translator{}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "Hi Tom-- " + year; plain != expected {
+		t.Errorf("expected %q, got %q", expected, plain)
+	}
+}
+
+func TestMailTemplates_Reload(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, file := range layoutFS(nil) {
+		write(name, string(file.Data))
+	}
+	write("hello.html.gohtml", `{{define "body"}}<p>Hello</p>{{end}}`)
+	write("hello.plain.gohtml", `{{define "body"}}Hello{{end}}`)
+
+	templates, err := NewMailTemplates(os.DirFS(dir), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("hello.plain.gohtml", `{{define "body"}}Hello again{{end}}`)
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(filepath.Join(dir, "hello.plain.gohtml"), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := templates.Plain("hello", &Translator{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "Hello again") {
+		t.Errorf("expected the edited template, got %q", out)
+	}
+}
+
+func TestMailTemplates_markdown(t *testing.T) {
+	fsys := layoutFS(fstest.MapFS{
+		emailLayout: {Data: []byte(`{{define "email"}}<title>{{.subject}}</title><i>{{.preheader}}</i>{{.content}}{{end}}`)},
+		"welcome.md.gohtml": {Data: []byte("---\nsubject: Welcome aboard\npreheader: Glad to have you\n---\n" +
+			"# Hi {{.name}}\n\nYour plan costs **{{currency .amount}}**. [Log in]({{.url}}) to get started.\n")},
+	})
+
+	templates, err := NewMailTemplates(fsys, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if subject := templates.Subject("welcome"); subject != "Welcome aboard" {
+		t.Errorf("expected the front matter subject, got %q", subject)
+	}
+
+	tr := testApp.Locales.Translator("en")
+	data := map[string]any{"name": "Tom & Jerry", "amount": 1000, "url": "https://example.com/login?a=1&b=2"}
+
+	html, err := templates.HTML("welcome", tr, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"<title>Welcome aboard</title>",
+		"<i>Glad to have you</i>",
+		"<h1>Hi Tom &amp; Jerry</h1>",
+		"<strong>$10.00</strong>",
+		`<a href="https://example.com/login?a=1&amp;b=2">Log in</a>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("expected html to contain %s, got:\n%s", want, html)
+		}
+	}
+
+	plain, err := templates.Plain("welcome", tr, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Hi Tom & Jerry\n==============\n\nYour plan costs $10.00. Log in (https://example.com/login?a=1&b=2) to get started.\n-- "
+	if !strings.HasPrefix(plain, expected) {
+		t.Errorf("unexpected plain text:\n%q\nexpected:\n%q", plain, expected)
+	}
+}
+
+func TestNewMailTemplates_markdownConflicts(t *testing.T) {
+	fsys := layoutFS(fstest.MapFS{
+		"welcome.md.gohtml":    {Data: []byte("Hi")},
+		"welcome.html.gohtml":  {Data: []byte(`{{define "body"}}<p>Hi</p>{{end}}`)},
+		"welcome.plain.gohtml": {Data: []byte(`{{define "body"}}Hi{{end}}`)},
+	})
+
+	_, err := NewMailTemplates(fsys, false)
+	if err == nil || !strings.Contains(err.Error(), "both Markdown and HTML") {
+		t.Errorf("expected a conflict error, got %v", err)
+	}
+
+	_, err = NewMailTemplates(fstest.MapFS{"welcome.md.gohtml": {Data: []byte("Hi")}}, false)
+	if err == nil || !strings.Contains(err.Error(), emailLayout) {
+		t.Errorf("expected an error about the missing layout, got %v", err)
+	}
+}
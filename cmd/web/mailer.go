@@ -1,9 +1,19 @@
 package main
 
 import (
-	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"simple-mailer-go/data"
 	"sync"
 	"time"
 
@@ -20,26 +30,196 @@ type Mail struct {
 	Encryption  string
 	FromAddress string
 	FromName    string
-	Wait        *sync.WaitGroup
-	MailerChan  chan Message
+	DKIM        map[string]DKIMKey
+	Transport   Transport
+	Queue       MailQueue
+	Templates   *MailTemplates
+	Locales     *Locales
+	Workers     int
+	Limiter     *RateLimiter
+	// Lint checks every message before it is sent. Warnings are logged and
+	// messages with errors go to the dead letter store.
+	Lint bool
+	// Tracking records opens and clicks through endpoints under BaseURL.
+	Tracking    bool
+	BaseURL     string
+	Signer      *URLSigner
+	RetryPolicy RetryPolicy
+	DeadLetters data.DeadLetterInterface
+	Log         data.MailLogInterface
+	InfoLog     *log.Logger
 	ErrorChan   chan error
 	DoneChan    chan bool
 }
 
 type Message struct {
+	ID            string
+	UserID        int
 	From          string
 	FromName      string
-	To            string
+	To            Addresses
+	Cc            Addresses
+	Bcc           Addresses
+	ReplyTo       string
 	Subject       string
 	Attachments   []string
 	AttachmentMap map[string]string
-	Data          any
-	DataMap       map[string]any
-	Template      string
+	// Files are attached from memory, so they travel through the queue with
+	// the message.
+	Files []Attachment
+	// InlineImages maps image names the HTML refers to with cid to files,
+	// adding to the images in the templates' images directory.
+	InlineImages map[string]string
+	// NoTracking leaves the message out of open and click tracking.
+	NoTracking bool
+	Data       any
+	DataMap    map[string]any
+	Template   string
+	// Language picks the translation of the subject and template.
+	Language string
+	SendAt   time.Time
+	QueueID  int `json:"-"`
+	Attempts int `json:"-"`
 }
 
-func (m *Mail) sendMail(msg Message, errorChan chan error) {
-	defer m.Wait.Done()
+// Attachment is a file attached to a message from memory.
+type Attachment struct {
+	Name     string
+	MimeType string
+	Data     []byte
+}
+
+// NewAttachment reads r into an attachment. An empty mimeType is guessed
+// from name.
+func NewAttachment(name, mimeType string, r io.Reader) (Attachment, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return Attachment{}, fmt.Errorf("reading attachment %s: %w", name, err)
+	}
+	return Attachment{Name: name, MimeType: mimeType, Data: b}, nil
+}
+
+// worker delivers queued messages one at a time until stop is closed. When
+// the transport supports it, the worker keeps its connection open between
+// messages.
+func (m *Mail) worker(errorChan chan error, stop chan bool) {
+	transport := m.Transport
+	if t, ok := transport.(SessionTransport); ok {
+		session := t.NewSession()
+		defer session.Close()
+		transport = session
+	}
+
+	for {
+		select {
+		case msg := <-m.Queue.Messages():
+			m.sendMail(msg, transport, errorChan)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// validate checks every address on the message, so a bad one fails the
+// message with an error that says which one it was.
+func (msg Message) validate() error {
+	if len(msg.To) == 0 {
+		return errors.New("message has no recipient")
+	}
+
+	if err := validateAddresses("To", msg.To...); err != nil {
+		return err
+	}
+	if err := validateAddresses("Cc", msg.Cc...); err != nil {
+		return err
+	}
+	if err := validateAddresses("Bcc", msg.Bcc...); err != nil {
+		return err
+	}
+	if msg.ReplyTo != "" {
+		return validateAddresses("Reply-To", msg.ReplyTo)
+	}
+
+	return nil
+}
+
+// unsubscribeURL is the address the unsubscribe link in the footer and the
+// List-Unsubscribe header point at, if the sender set one.
+func (msg Message) unsubscribeURL() string {
+	u, _ := msg.DataMap["unsubscribe"].(string)
+	return u
+}
+
+func (msg Message) recipients() Addresses {
+	var all Addresses
+	all = append(all, msg.To...)
+	all = append(all, msg.Cc...)
+	all = append(all, msg.Bcc...)
+	return all
+}
+
+func (m *Mail) sendMail(msg Message, transport Transport, errorChan chan error) {
+	if msg.ID == "" {
+		msg.ID = newMessageID()
+	}
+
+	// a message that is invalid, does not render or fails the lint will not
+	// do better on the next attempt, so it goes straight to the dead letter
+	// store
+	rendered, err := m.render(msg)
+	if err == nil && m.Lint {
+		results := lintMessage(rendered)
+		for _, warning := range results.Warnings() {
+			m.InfoLog.Printf("lint mail %s to %s: %s", msg.ID, msg.To, warning)
+		}
+		err = results.Err()
+	}
+	var email *mail.Email
+	if err == nil {
+		email, err = m.build(rendered)
+	}
+	if err != nil {
+		m.deadLetter(msg, err, errorChan)
+		return
+	}
+
+	if m.Limiter != nil {
+		if waited := m.Limiter.Wait(); waited > 0 {
+			m.InfoLog.Printf("throttled mail %s to %s for %s", msg.ID, msg.To, waited)
+		}
+	}
+
+	m.logStatus(msg, data.MailStatusSending, "", errorChan)
+
+	reply, err := transport.Send(email)
+	if errors.Is(err, errRejected) {
+		m.bounce(msg, err, errorChan)
+		return
+	}
+	if err != nil {
+		m.fail(msg, err, errorChan)
+		return
+	}
+
+	m.logStatus(msg, data.MailStatusSent, reply, errorChan)
+
+	if err = m.Queue.Ack(msg); err != nil {
+		errorChan <- err
+	}
+}
+
+// renderedMessage is a message with its defaults filled in and its subject
+// and both parts rendered.
+type renderedMessage struct {
+	Message
+	Subject string
+	HTML    string
+	Plain   string
+	// Images are the inline images the HTML refers to.
+	Images []*mail.File
+}
+
+func (m *Mail) render(msg Message) (renderedMessage, error) {
 	if msg.Template == "" {
 		msg.Template = "mail"
 	}
@@ -52,105 +232,219 @@ func (m *Mail) sendMail(msg Message, errorChan chan error) {
 		msg.FromName = m.FromName
 	}
 
-	// data := map[string]any{
-	// 	"message": msg.Data,
-	// }
-
-	if len(msg.DataMap) == 0 {
-		msg.DataMap = make(map[string]any)
-	}
-	if msg.AttachmentMap == nil {
-		msg.AttachmentMap = make(map[string]string)
+	dataMap := make(map[string]any, len(msg.DataMap)+2)
+	for k, v := range msg.DataMap {
+		dataMap[k] = v
 	}
+	msg.DataMap = dataMap
 
+	subject := m.Locales.Translator(msg.Language).T(m.subject(msg))
 	msg.DataMap["message"] = msg.Data
+	msg.DataMap["subject"] = subject
+
+	if err := msg.validate(); err != nil {
+		return renderedMessage{}, err
+	}
 
 	formattedMessage, err := m.buildHTMLMessage(msg)
 	if err != nil {
-		errorChan <- err
+		return renderedMessage{}, err
 	}
 
 	plainMessage, err := m.buildPlainTextMessage(msg)
 	if err != nil {
-		errorChan <- err
+		return renderedMessage{}, err
 	}
 
-	server := mail.NewSMTPClient()
-	server.Host = m.Host
-	server.Port = m.Port
-	server.Username = m.Username
-	server.Password = m.Password
-	server.Encryption = m.getEncryption(m.Encryption)
-	server.KeepAlive = false
-	server.ConnectTimeout = 10 * time.Second
-	server.SendTimeout = 10 * time.Second
+	images, err := m.inlineImages(msg, formattedMessage)
+	if err != nil {
+		return renderedMessage{}, err
+	}
+
+	return renderedMessage{Message: msg, Subject: subject, HTML: formattedMessage, Plain: plainMessage, Images: images}, nil
+}
 
-	smtpClient, err := server.Connect()
+var cidPattern = regexp.MustCompile(`(?:src|href)="cid:([^"]+)"`)
+
+// inlineImages loads every image html refers to by cid, from the message's
+// InlineImages or else the templates' images. The transport gives each one
+// its Content-ID and points the references at it.
+func (m *Mail) inlineImages(msg Message, html string) ([]*mail.File, error) {
+	var images []*mail.File
+	seen := make(map[string]bool)
+	for _, match := range cidPattern.FindAllStringSubmatch(html, -1) {
+		name := match[1]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		var b []byte
+		var err error
+		if file, ok := msg.InlineImages[name]; ok {
+			b, err = os.ReadFile(file)
+		} else {
+			b, err = m.Templates.Image(name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("inline image %s: %w", name, err)
+		}
+
+		mimeType := mime.TypeByExtension(filepath.Ext(name))
+		if mimeType == "" {
+			mimeType = http.DetectContentType(b)
+		}
+		images = append(images, &mail.File{Name: name, MimeType: mimeType, Data: b, Inline: true})
+	}
+	return images, nil
+}
+
+// compose renders msg into an email ready to hand to a transport.
+func (m *Mail) compose(msg Message) (*mail.Email, error) {
+	rendered, err := m.render(msg)
 	if err != nil {
-		errorChan <- err
+		return nil, err
 	}
+	return m.build(rendered)
+}
+
+func (m *Mail) build(rendered renderedMessage) (*mail.Email, error) {
+	msg := rendered.Message
 
 	email := mail.NewMSG()
-	email.SetFrom(msg.From).AddTo(msg.To).SetSubject(msg.Subject)
+	email.AddHeader("Message-ID", fmt.Sprintf("<%s@%s>", msg.ID, m.Domain))
+	email.SetFrom(msg.From).AddTo(msg.To...).AddCc(msg.Cc...).AddBcc(msg.Bcc...).SetSubject(rendered.Subject)
+	if msg.ReplyTo != "" {
+		email.SetReplyTo(msg.ReplyTo)
+	}
+	if u := msg.unsubscribeURL(); u != "" {
+		email.AddHeader("List-Unsubscribe", "<"+u+">")
+	}
 
-	email.SetBody(mail.TextPlain, plainMessage)
-	email.AddAlternative(mail.TextHTML, formattedMessage)
+	email.SetBody(mail.TextPlain, rendered.Plain)
+	email.AddAlternative(mail.TextHTML, rendered.HTML)
 
-	if len(msg.Attachments) > 0 {
-		for _, x := range msg.Attachments {
-			email.AddAttachment(x)
-		}
+	for _, image := range rendered.Images {
+		email.Attach(image)
 	}
-	if len(msg.AttachmentMap) > 0 {
-		for k, v := range msg.AttachmentMap {
-			email.AddAttachment(v, k)
-		}
+	for _, x := range msg.Attachments {
+		email.AddAttachment(x)
+	}
+	for k, v := range msg.AttachmentMap {
+		email.AddAttachment(v, k)
+	}
+	for _, file := range msg.Files {
+		email.Attach(&mail.File{Name: file.Name, MimeType: file.MimeType, Data: file.Data})
 	}
 
-	err = email.Send(smtpClient)
-	if err != nil {
+	if key, ok := m.DKIM[senderDomain(msg.From)]; ok {
+		email.SetDkim(key.options())
+	}
+
+	if err := email.GetError(); err != nil {
+		return nil, err
+	}
+
+	return email, nil
+}
+
+// fail schedules another attempt for msg, or moves it to the dead letter
+// store once the retry policy gives up on it.
+func (m *Mail) fail(msg Message, err error, errorChan chan error) {
+	msg.Attempts++
+	if msg.Attempts >= m.RetryPolicy.MaxAttempts {
+		m.deadLetter(msg, err, errorChan)
+		return
+	}
+
+	delay := m.RetryPolicy.Backoff(msg.Attempts)
+	errorChan <- fmt.Errorf("sending mail to %s failed (attempt %d), retrying in %s: %w", msg.To, msg.Attempts, delay.Round(time.Second), err)
+
+	m.logStatus(msg, data.MailStatusQueued, err.Error(), errorChan)
+
+	if err := m.Queue.Retry(msg, delay, err); err != nil {
 		errorChan <- err
 	}
 }
 
-func (m *Mail) buildHTMLMessage(msg Message) (string, error) {
-	templateToRender := fmt.Sprintf("./cmd/web/templates/%s.html.gohtml", msg.Template)
+func (m *Mail) deadLetter(msg Message, err error, errorChan chan error) {
+	errorChan <- fmt.Errorf("giving up on mail to %s after %d attempts: %w", msg.To, msg.Attempts, err)
+	m.logStatus(msg, data.MailStatusFailed, err.Error(), errorChan)
 
-	t, err := template.New("email-html").ParseFiles(templateToRender)
-	if err != nil {
-		return "", err
+	payload, jsonErr := json.Marshal(msg)
+	if jsonErr != nil {
+		errorChan <- jsonErr
+		return
+	}
+
+	if _, dbErr := m.DeadLetters.Insert(payload, err.Error(), msg.Attempts); dbErr != nil {
+		errorChan <- dbErr
+		return
+	}
+
+	if ackErr := m.Queue.Ack(msg); ackErr != nil {
+		errorChan <- ackErr
 	}
+}
+
+// bounce records a message the relay refused for good. It is neither retried
+// nor kept as a dead letter, since it would be refused again.
+func (m *Mail) bounce(msg Message, err error, errorChan chan error) {
+	errorChan <- fmt.Errorf("mail to %s bounced: %w", msg.To, err)
+	m.logStatus(msg, data.MailStatusBounced, err.Error(), errorChan)
+
+	if ackErr := m.Queue.Ack(msg); ackErr != nil {
+		errorChan <- ackErr
+	}
+}
+
+func (m *Mail) logStatus(msg Message, status, response string, errorChan chan error) {
+	if err := m.Log.UpdateStatus(msg.ID, status, response); err != nil {
+		errorChan <- fmt.Errorf("updating status of mail %s: %w", msg.ID, err)
+	}
+}
+
+// newMessageID returns a random id that identifies a message in the mail log
+// and in its Message-ID header.
+func newMessageID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
 
-	var tpl bytes.Buffer
-	if err = t.ExecuteTemplate(&tpl, "body", msg.DataMap); err != nil {
+func (m *Mail) buildHTMLMessage(msg Message) (string, error) {
+	formattedMessage, err := m.Templates.HTML(msg.Template, m.Locales.Translator(msg.Language), msg.DataMap)
+	if err != nil {
 		return "", err
 	}
 
-	formattedMessage := tpl.String()
 	formattedMessage, err = m.inlineCSS(formattedMessage)
 	if err != nil {
 		return "", err
 	}
 
+	if m.tracks(msg) {
+		formattedMessage = m.track(msg.ID, formattedMessage)
+	}
+
 	return formattedMessage, nil
 }
 
 func (m *Mail) buildPlainTextMessage(msg Message) (string, error) {
-	templateToRender := fmt.Sprintf("./cmd/web/templates/%s.plain.gohtml", msg.Template)
+	return m.Templates.Plain(msg.Template, m.Locales.Translator(msg.Language), msg.DataMap)
+}
 
-	t, err := template.New("email-plain").ParseFiles(templateToRender)
-	if err != nil {
-		return "", err
+// subject returns msg's subject, or the one in its template's front matter.
+func (m *Mail) subject(msg Message) string {
+	if msg.Subject != "" || m.Templates == nil {
+		return msg.Subject
 	}
 
-	var tpl bytes.Buffer
-	if err = t.ExecuteTemplate(&tpl, "body", msg.DataMap); err != nil {
-		return "", err
+	template := msg.Template
+	if template == "" {
+		template = "mail"
 	}
-
-	plainMessage := tpl.String()
-
-	return plainMessage, nil
+	return m.Templates.Subject(template)
 }
 
 func (m *Mail) inlineCSS(s string) (string, error) {
@@ -173,28 +467,42 @@ func (m *Mail) inlineCSS(s string) (string, error) {
 	return html, nil
 }
 
-func (m *Mail) getEncryption(e string) mail.Encryption {
-	switch e {
-	case "tls":
-		return mail.EncryptionSTARTTLS
-	case "ssl":
-		return mail.EncryptionSSLTLS
-	case "none":
-		return mail.EncryptionNone
-	default:
-		return mail.EncryptionSTARTTLS
+func (app *Config) listenForMail() {
+	workers := app.Mailer.Workers
+	if workers < 1 {
+		workers = 1
 	}
-}
 
-func (app *Config) listenForMail() {
+	stop := make(chan bool)
+	var running sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			app.Mailer.worker(app.Mailer.ErrorChan, stop)
+		}()
+	}
+
+	// Errors are still logged while the workers and the queue wind down.
+	// DoneChan is answered once they have stopped writing to ErrorChan.
+	done := app.Mailer.DoneChan
+	stopped := make(chan bool)
 	for {
 		select {
-		case msg := <-app.Mailer.MailerChan:
-			app.Mailer.Wait.Add(1)
-			go app.Mailer.sendMail(msg, app.Mailer.ErrorChan)
 		case err := <-app.Mailer.ErrorChan:
 			app.ErrorLog.Println(err)
-		case <-app.Mailer.DoneChan:
+		case <-done:
+			done = nil
+			close(stop)
+			go func() {
+				running.Wait()
+				if err := app.Mailer.Queue.Close(); err != nil {
+					app.ErrorLog.Println(err)
+				}
+				close(stopped)
+			}()
+		case <-stopped:
+			app.Mailer.DoneChan <- true
 			return
 		}
 	}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"simple-mailer-go/data"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+func TestMail_sendMail(t *testing.T) {
+	testTransport.Reset()
+
+	testApp.sendEmail(Message{
+		To:       []string{"me@here.com"},
+		Subject:  "Activate your account",
+		Template: "confirmation-email",
+		Data:     "http://localhost/activate?email=me@here.com",
+	})
+
+	sent := waitForMail(t, 1)
+	if sent[0].Recipients[0] != "me@here.com" {
+		t.Errorf("expected mail to me@here.com, got %v", sent[0].Recipients)
+	}
+	if !strings.Contains(sent[0].Raw, "Click the link below to activate your account.") {
+		t.Error("expected rendered confirmation email")
+	}
+}
+
+func TestMail_sendMail_recipients(t *testing.T) {
+	testTransport.Reset()
+
+	testApp.sendEmail(Message{
+		To:      []string{"one@here.com", "two@here.com"},
+		Cc:      []string{"team@here.com"},
+		Bcc:     []string{"admin@here.com"},
+		ReplyTo: "support@here.com",
+		Subject: "Team notification",
+		Data:    "hello team",
+	})
+
+	sent := waitForMail(t, 1)
+	if len(sent[0].Recipients) != 4 {
+		t.Errorf("expected 4 recipients, got %v", sent[0].Recipients)
+	}
+	if !strings.Contains(sent[0].Raw, "Reply-To: <support@here.com>") {
+		t.Error("expected Reply-To header")
+	}
+	if strings.Contains(sent[0].Raw, "admin@here.com") {
+		t.Error("expected Bcc address to be left out of the headers")
+	}
+}
+
+func TestMessage_validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      Message
+		expected string
+	}{
+		{"valid", Message{To: []string{"me@here.com"}, Cc: []string{"Team <team@here.com>"}}, ""},
+		{"no recipient", Message{}, "message has no recipient"},
+		{"bad to", Message{To: []string{"me@here.com", "nobody"}}, `invalid To address "nobody"`},
+		{"bad bcc", Message{To: []string{"me@here.com"}, Bcc: []string{"@here"}}, `invalid Bcc address "@here"`},
+		{"bad reply to", Message{To: []string{"me@here.com"}, ReplyTo: "support"}, `invalid Reply-To address "support"`},
+	}
+
+	for _, e := range tests {
+		err := e.msg.validate()
+		if e.expected == "" && err != nil {
+			t.Errorf("%s: expected no error, got %s", e.name, err)
+		}
+		if e.expected != "" && (err == nil || !strings.Contains(err.Error(), e.expected)) {
+			t.Errorf("%s: expected error containing %s, got %v", e.name, e.expected, err)
+		}
+	}
+}
+
+func TestAddresses_UnmarshalJSON(t *testing.T) {
+	var msg Message
+	_ = json.Unmarshal([]byte(`{"To":"me@here.com","Cc":["a@here.com","b@here.com"]}`), &msg)
+
+	if len(msg.To) != 1 || msg.To[0] != "me@here.com" {
+		t.Errorf("expected a single string to decode as one address, got %v", msg.To)
+	}
+	if len(msg.Cc) != 2 {
+		t.Errorf("expected a list to decode as is, got %v", msg.Cc)
+	}
+}
+
+type statusRecorder struct {
+	data.MailLogTest
+	mu        sync.Mutex
+	statuses  []string
+	responses []string
+}
+
+func (s *statusRecorder) UpdateStatus(id, status, response string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses = append(s.statuses, status)
+	s.responses = append(s.responses, response)
+	return nil
+}
+
+func TestMail_sendMail_status(t *testing.T) {
+	recorder := &statusRecorder{}
+	m := Mail{
+		FromAddress: "info@localhost",
+		Templates:   testApp.Mailer.Templates,
+		Queue:       NewMemoryQueue(1),
+		RetryPolicy: RetryPolicy{MaxAttempts: 1},
+		DeadLetters: testApp.Models.DeadLetter,
+		Log:         recorder,
+	}
+	errorChan := make(chan error, 10)
+
+	accepted := replyTransport{reply: "250 2.0.0 Ok: queued as 4F2A1"}
+	m.sendMail(Message{ID: "1", To: []string{"me@here.com"}, Data: "hello"}, accepted, errorChan)
+
+	unavailable := replyTransport{err: &textproto.Error{Code: 451, Msg: "4.3.0 try again later"}}
+	m.sendMail(Message{ID: "2", To: []string{"me@here.com"}, Data: "hello"}, unavailable, errorChan)
+
+	unknown := replyTransport{err: rejected(&textproto.Error{Code: 550, Msg: "5.1.1 no such user"})}
+	m.sendMail(Message{ID: "3", To: []string{"me@here.com"}, Data: "hello"}, unknown, errorChan)
+
+	expected := []string{
+		data.MailStatusSending, data.MailStatusSent,
+		data.MailStatusSending, data.MailStatusFailed,
+		data.MailStatusSending, data.MailStatusBounced,
+	}
+	if strings.Join(recorder.statuses, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected statuses %v, got %v", expected, recorder.statuses)
+	}
+	if recorder.responses[1] != accepted.reply {
+		t.Errorf("expected the relay's reply to be logged, got %q", recorder.responses[1])
+	}
+	if !strings.Contains(recorder.responses[5], "550 5.1.1 no such user") {
+		t.Errorf("expected the rejection to be logged, got %q", recorder.responses[5])
+	}
+}
+
+// replyTransport answers every message with reply or err.
+type replyTransport struct {
+	reply string
+	err   error
+}
+
+func (r replyTransport) Send(email *mail.Email) (string, error) {
+	return r.reply, r.err
+}
+
+func TestMail_compose_inlineImages(t *testing.T) {
+	email, err := testApp.Mailer.compose(Message{ID: "1", To: []string{"me@here.com"}, Subject: "Hello", Data: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := rawMessage(email)
+	for _, want := range []string{"multipart/related", "Content-Id: <", "Content-Type: image/png", "Content-Disposition: inline"} {
+		if !strings.Contains(raw, want) {
+			t.Errorf("expected the logo to be embedded with %s", want)
+		}
+	}
+	if strings.Contains(raw, `src=3D"cid:logo.png"`) {
+		t.Error("expected the logo reference to point at its Content-ID")
+	}
+
+	chart := filepath.Join(t.TempDir(), "chart.png")
+	if err := os.WriteFile(chart, []byte("\x89PNG\r\n\x1a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := NewMailTemplates(layoutFS(fstest.MapFS{
+		"report.html.gohtml":  {Data: []byte(`{{define "body"}}<img src="{{cid "chart.png"}}">{{end}}`)},
+		"report.plain.gohtml": {Data: []byte(`{{define "body"}}See the chart{{end}}`)},
+	}), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Mail{FromAddress: "info@localhost", Templates: templates}
+
+	rendered, err := m.render(Message{To: []string{"me@here.com"}, Template: "report", InlineImages: map[string]string{"chart.png": chart}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rendered.Images) != 1 || rendered.Images[0].Name != "chart.png" || !rendered.Images[0].Inline {
+		t.Errorf("expected chart.png to be embedded, got %v", rendered.Images)
+	}
+
+	_, err = m.render(Message{To: []string{"me@here.com"}, Template: "report"})
+	if err == nil || !strings.Contains(err.Error(), "inline image chart.png") {
+		t.Errorf("expected an error for a missing inline image, got %v", err)
+	}
+}
+
+func TestMail_compose_files(t *testing.T) {
+	report, err := NewAttachment("report.csv", "text/csv", strings.NewReader("plan,amount\nbronze,1000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the message goes through the queue as JSON, so check the files survive it
+	payload, _ := json.Marshal(Message{ID: "1", To: []string{"me@here.com"}, Subject: "Report", Data: "hi", Files: []Attachment{report}})
+	var msg Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	email, err := testApp.Mailer.compose(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := rawMessage(email)
+	for _, want := range []string{"Content-Type: text/csv;", `filename="report.csv"`, "cGxhbixhbW91bnQKYnJvbnplLDEwMDAK"} {
+		if !strings.Contains(raw, want) {
+			t.Errorf("expected attachment to contain %s", want)
+		}
+	}
+}
+
+func TestMail_render_afterQueue(t *testing.T) {
+	link := "http://localhost:3000/activate?email=me%40here.com&token=abc&hash=def"
+
+	// links go through the queue as JSON, which turns template.HTML into a
+	// plain string
+	payload, _ := json.Marshal(Message{ID: "1", To: []string{"me@here.com"}, Template: "confirmation-email", Data: template.HTML(link)})
+	var msg Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	rendered, err := testApp.Mailer.render(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(rendered.Plain, link) {
+		t.Errorf("expected the plain text part to have the link unescaped, got %s", rendered.Plain)
+	}
+	if !strings.Contains(rendered.HTML, `href="http://localhost:3000/activate?email=me%40here.com&amp;token=abc&amp;hash=def"`) {
+		t.Error("expected the HTML part to have the link escaped for HTML")
+	}
+}
+
+// blockingTransport holds every send until release is closed.
+type blockingTransport struct {
+	started chan bool
+	release chan bool
+}
+
+func (b blockingTransport) Send(email *mail.Email) (string, error) {
+	b.started <- true
+	<-b.release
+	return "", nil
+}
+
+func TestConfig_listenForMail_stop(t *testing.T) {
+	transport := blockingTransport{started: make(chan bool, 1), release: make(chan bool)}
+	app := testApp
+	app.Mailer.Transport = transport
+	app.Mailer.Queue = NewMemoryQueue(1)
+	app.Mailer.DoneChan = make(chan bool)
+	app.Mailer.ErrorChan = make(chan error)
+
+	go app.listenForMail()
+
+	_ = app.Mailer.Queue.Push(Message{To: []string{"me@here.com"}, Data: "hello"})
+	select {
+	case <-transport.started:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the worker to pick up the message")
+	}
+
+	app.Mailer.DoneChan <- true
+
+	select {
+	case <-app.Mailer.DoneChan:
+		t.Fatal("expected the mailer to wait for the message being sent")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(transport.release)
+
+	select {
+	case <-app.Mailer.DoneChan:
+	case <-time.After(time.Second):
+		t.Fatal("expected the mailer to answer once the worker stopped")
+	}
+
+	later := Message{To: []string{"me@here.com"}, SendAt: time.Now().Add(time.Hour)}
+	if err := app.Mailer.Queue.Push(later); !errors.Is(err, errQueueClosed) {
+		t.Errorf("expected the queue to be closed, got %v", err)
+	}
+}
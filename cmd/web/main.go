@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"encoding/gob"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -24,6 +25,29 @@ import (
 var port = os.Getenv("PORT")
 
 func main() {
+	dev := flag.Bool("dev", false, "reload templates from disk when they change")
+	flag.Parse()
+
+	mailSettings, err := loadMailSettings(os.Getenv("MAIL_CONFIG"))
+	if err != nil {
+		log.Fatalf("invalid mail configuration:\n%s", err)
+	}
+
+	pageTemplates, err := NewPageTemplates(templatesFS(*dev), *dev)
+	if err != nil {
+		log.Fatalf("invalid page templates:\n%s", err)
+	}
+
+	mailTemplates, err := NewMailTemplates(templatesFS(*dev), *dev)
+	if err != nil {
+		log.Fatalf("invalid email templates:\n%s", err)
+	}
+
+	locales, err := LoadLocales(localesFS(), defaultLanguage)
+	if err != nil {
+		log.Fatalf("invalid translations:\n%s", err)
+	}
+
 	db := initDB()
 	db.Ping()
 	session := initSession()
@@ -39,10 +63,19 @@ func main() {
 		ErrorLog:  errorLog,
 		Wait:      &wg,
 		Models:    data.New(db),
+		Templates: pageTemplates,
+		Locales:   locales,
+		BaseURL:   mailSettings.BaseURL,
 		ErrorChan: make(chan error),
 		DoneChan:  make(chan bool),
+
+		ActivationExpiry: mailSettings.ActivationLinkExpiry,
+		ResetExpiry:      mailSettings.ResetLinkExpiry,
+		TrustedProxies:   mailSettings.Proxies,
+		AllowedHosts:     mailSettings.AllowedHosts,
+		Signer:           mailSettings.Signer,
 	}
-	app.Mailer = app.createMail()
+	app.Mailer = app.createMail(mailSettings, mailTemplates)
 	go app.listenForMail()
 	go app.listenForErrors()
 	go app.listenForShutdown()
@@ -148,30 +181,127 @@ func (app *Config) shutdown() {
 
 	app.Wait.Wait()
 	app.Mailer.DoneChan <- true
+	<-app.Mailer.DoneChan
 	app.DoneChan <- true
 
-	close(app.Mailer.MailerChan)
 	close(app.Mailer.DoneChan)
 	close(app.Mailer.ErrorChan)
 	close(app.DoneChan)
 	app.InfoLog.Println("Shutting down.")
 }
 
-func (app *Config) createMail() Mail {
-	return Mail{
-		Domain:      "localhost",
-		Host:        "localhost",
-		Port:        1025,
-		Encryption:  "none",
-		FromName:    "Info",
-		FromAddress: "info@localhost",
-		MailerChan:  make(chan Message, 100),
-		ErrorChan:   make(chan error),
+func (app *Config) createMail(settings MailSettings, templates *MailTemplates) Mail {
+	errorChan := make(chan error)
+
+	var queue MailQueue
+	if settings.Queue == "memory" {
+		queue = NewMemoryQueue(100)
+	} else {
+		queue = NewPostgresQueue(app.Models.MailQueue, 100, 5*time.Second, errorChan)
+	}
+
+	m := Mail{
+		Domain:      settings.Domain,
+		Host:        settings.Host,
+		Port:        settings.Port,
+		Username:    settings.Username,
+		Password:    settings.Password,
+		Encryption:  settings.Encryption,
+		FromName:    settings.FromName,
+		FromAddress: settings.FromAddress,
+		DKIM:        settings.DKIMKeys,
+		Queue:       queue,
+		Templates:   templates,
+		Locales:     app.Locales,
+		Workers:     settings.Workers,
+		Lint:        settings.Lint,
+		Tracking:    settings.Tracking,
+		BaseURL:     settings.BaseURL,
+		Signer:      app.Signer,
+		Limiter: &RateLimiter{
+			PerRecipient:    settings.RateLimitPerRecipient,
+			PerTemplate:     settings.RateLimitTemplates,
+			GlobalPerSecond: settings.RateLimitGlobal,
+		},
+		RetryPolicy: RetryPolicy{
+			MaxAttempts: settings.MaxAttempts,
+			BaseDelay:   settings.RetryDelay,
+			MaxDelay:    settings.MaxRetryDelay,
+			Jitter:      defaultRetryPolicy.Jitter,
+		},
+		DeadLetters: app.Models.DeadLetter,
+		Log:         app.Models.MailLog,
+		InfoLog:     app.InfoLog,
+		ErrorChan:   errorChan,
 		DoneChan:    make(chan bool),
-		Wait:        app.Wait,
 	}
+
+	switch settings.Transport {
+	case "file":
+		dir := settings.DropDir
+		if dir == "" {
+			dir = fmt.Sprintf("%s/mail", tmpPath)
+		}
+		m.Transport = &FileTransport{Dir: dir}
+	case "memory":
+		m.Transport = NewMemoryTransport()
+	default:
+		m.Transport = &SMTPTransport{
+			Host:                  m.Host,
+			Port:                  m.Port,
+			Username:              m.Username,
+			Password:              m.Password,
+			Encryption:            m.Encryption,
+			MessagesPerConnection: settings.MessagesPerConnection,
+		}
+	}
+
+	return m
 }
 
-func (app *Config) sendEmail(msg Message) {
-	app.Mailer.MailerChan <- msg
+// sendEmail records msg in the mail log and queues it for delivery. New
+// messages over a rate limit are logged as suppressed instead. A message that
+// already has an id, e.g. a replayed dead letter, keeps it and skips the
+// limits.
+func (app *Config) sendEmail(msg Message) error {
+	if msg.Subject == "" {
+		msg.Subject = app.Mailer.subject(msg)
+	}
+
+	var err error
+	if msg.ID == "" {
+		msg.ID = newMessageID()
+		err = app.Models.MailLog.Insert(data.MailLog{
+			ID:         msg.ID,
+			UserID:     msg.UserID,
+			Recipients: msg.recipients().String(),
+			Subject:    msg.Subject,
+			Template:   msg.Template,
+		})
+		if err != nil {
+			app.ErrorLog.Println("failed to log mail:", err)
+		}
+
+		if app.Mailer.Limiter != nil {
+			if limitErr := app.Mailer.Limiter.Allow(msg); limitErr != nil {
+				app.InfoLog.Printf("suppressed mail %s %q: %s", msg.ID, msg.Subject, limitErr)
+				if err = app.Models.MailLog.UpdateStatus(msg.ID, data.MailStatusSuppressed, limitErr.Error()); err != nil {
+					app.ErrorLog.Println("failed to log mail:", err)
+				}
+				return fmt.Errorf("%w: %w", errRateLimited, limitErr)
+			}
+		}
+	} else {
+		err = app.Models.MailLog.UpdateStatus(msg.ID, data.MailStatusQueued, "")
+		if err != nil {
+			app.ErrorLog.Println("failed to log mail:", err)
+		}
+	}
+
+	err = app.Mailer.Queue.Push(msg)
+	if err != nil {
+		app.ErrorLog.Println("failed to queue mail:", err)
+	}
+
+	return err
 }
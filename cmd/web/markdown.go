@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+	"gopkg.in/yaml.v3"
+)
+
+var markdown = goldmark.New()
+
+// frontMatter is the YAML block at the top of a Markdown email template.
+type frontMatter struct {
+	Subject   string `yaml:"subject"`
+	Preheader string `yaml:"preheader"`
+	// Tracking: false leaves messages from the template untracked.
+	Tracking *bool `yaml:"tracking"`
+}
+
+// splitFrontMatter separates the front matter, delimited by --- lines, from
+// the Markdown that follows. A source without front matter is all Markdown.
+func splitFrontMatter(src []byte) (frontMatter, []byte, error) {
+	var fm frontMatter
+
+	src = bytes.ReplaceAll(src, []byte("\r\n"), []byte("\n"))
+	rest, ok := bytes.CutPrefix(src, []byte("---\n"))
+	if !ok {
+		return fm, src, nil
+	}
+
+	header, body, ok := bytes.Cut(rest, []byte("\n---\n"))
+	if !ok {
+		header, ok = bytes.CutSuffix(rest, []byte("\n---"))
+		if !ok {
+			return fm, nil, errors.New("front matter is not closed with ---")
+		}
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(header))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fm); err != nil {
+		return fm, nil, fmt.Errorf("front matter: %w", err)
+	}
+
+	return fm, body, nil
+}
+
+func markdownToHTML(src string) (string, error) {
+	var b bytes.Buffer
+	if err := markdown.Convert([]byte(src), &b); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// markdownToText renders Markdown as plain text for the text/plain part of
+// an email: markup is dropped, links are followed by their address and
+// headings are underlined.
+func markdownToText(src string) string {
+	source := []byte(src)
+	doc := markdown.Parser().Parse(text.NewReader(source))
+
+	w := plainWriter{source: source}
+	lines := w.blocks(doc, true)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+type plainWriter struct {
+	source []byte
+}
+
+// blocks renders the block children of n, separated by blank lines unless
+// tight.
+func (w plainWriter) blocks(n ast.Node, loose bool) []string {
+	var lines []string
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		block := w.block(c)
+		if len(block) == 0 {
+			continue
+		}
+		if len(lines) > 0 && loose {
+			lines = append(lines, "")
+		}
+		lines = append(lines, block...)
+	}
+	return lines
+}
+
+func (w plainWriter) block(n ast.Node) []string {
+	switch n := n.(type) {
+	case *ast.Paragraph, *ast.TextBlock:
+		return strings.Split(w.inline(n), "\n")
+	case *ast.Heading:
+		heading := w.inline(n)
+		underline := "-"
+		if n.Level == 1 {
+			underline = "="
+		}
+		return []string{heading, strings.Repeat(underline, utf8.RuneCountInString(heading))}
+	case *ast.List:
+		var lines []string
+		i := n.Start
+		for item := n.FirstChild(); item != nil; item = item.NextSibling() {
+			marker := "- "
+			if n.IsOrdered() {
+				marker = fmt.Sprintf("%d. ", i)
+				i++
+			}
+			if len(lines) > 0 && !n.IsTight {
+				lines = append(lines, "")
+			}
+			for j, line := range w.blocks(item, !n.IsTight) {
+				if j == 0 {
+					line = marker + line
+				} else if line != "" {
+					line = strings.Repeat(" ", len(marker)) + line
+				}
+				lines = append(lines, line)
+			}
+		}
+		return lines
+	case *ast.Blockquote:
+		lines := w.blocks(n, true)
+		for i, line := range lines {
+			lines[i] = strings.TrimRight("> "+line, " ")
+		}
+		return lines
+	case *ast.FencedCodeBlock, *ast.CodeBlock:
+		var lines []string
+		segments := n.Lines()
+		for i := 0; i < segments.Len(); i++ {
+			segment := segments.At(i)
+			lines = append(lines, html.UnescapeString(strings.TrimRight(string(segment.Value(w.source)), "\n")))
+		}
+		return lines
+	case *ast.ThematicBreak:
+		return []string{"----------"}
+	case *ast.HTMLBlock:
+		return nil
+	default:
+		return w.blocks(n, true)
+	}
+}
+
+func (w plainWriter) inline(n ast.Node) string {
+	var b strings.Builder
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		switch c := c.(type) {
+		case *ast.Text:
+			b.WriteString(html.UnescapeString(string(c.Segment.Value(w.source))))
+			if c.SoftLineBreak() || c.HardLineBreak() {
+				b.WriteString("\n")
+			}
+		case *ast.String:
+			b.Write(c.Value)
+		case *ast.Link:
+			label := w.inline(c)
+			dest := html.UnescapeString(string(c.Destination))
+			if label == dest || label == "" {
+				b.WriteString(dest)
+			} else {
+				fmt.Fprintf(&b, "%s (%s)", label, dest)
+			}
+		case *ast.AutoLink:
+			b.WriteString(html.UnescapeString(string(c.URL(w.source))))
+		case *ast.RawHTML:
+		default:
+			b.WriteString(w.inline(c))
+		}
+	}
+	return b.String()
+}
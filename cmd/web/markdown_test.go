@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestSplitFrontMatter(t *testing.T) {
+	fm, body, err := splitFrontMatter([]byte("---\r\nsubject: Hello\r\npreheader: World\r\n---\r\nBody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fm.Subject != "Hello" || fm.Preheader != "World" {
+		t.Errorf("unexpected front matter %+v", fm)
+	}
+	if string(body) != "Body\n" {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	_, body, err = splitFrontMatter([]byte("No front matter\n---\n"))
+	if err != nil || string(body) != "No front matter\n---\n" {
+		t.Errorf("expected the source back untouched, got %q, %v", body, err)
+	}
+
+	if _, _, err := splitFrontMatter([]byte("---\nsubject: Hi\nBody\n")); err == nil {
+		t.Error("expected an error for unclosed front matter")
+	}
+	if _, _, err := splitFrontMatter([]byte("---\nsubjet: Hi\n---\nBody\n")); err == nil {
+		t.Error("expected an error for an unknown front matter field")
+	}
+}
+
+func TestMarkdownToText(t *testing.T) {
+	src := "## Your order\n\n" +
+		"Thanks for *shopping* with `us`.\n\n" +
+		"- Bronze plan\n- Support: <https://example.com/help>\n\n" +
+		"1. Download the [manual](https://example.com/manual)\n2. Log in\n\n" +
+		"> Questions? Reply to this email.\n\n" +
+		"---\n\n" +
+		"<p>raw html is dropped</p>\n\n" +
+		"See you soon,  \nThe team\n"
+
+	expected := "Your order\n" +
+		"----------\n\n" +
+		"Thanks for shopping with us.\n\n" +
+		"- Bronze plan\n- Support: https://example.com/help\n\n" +
+		"1. Download the manual (https://example.com/manual)\n2. Log in\n\n" +
+		"> Questions? Reply to this email.\n\n" +
+		"----------\n\n" +
+		"See you soon,\nThe team\n"
+
+	if got := markdownToText(src); got != expected {
+		t.Errorf("unexpected text:\n%s\nexpected:\n%s", got, expected)
+	}
+}
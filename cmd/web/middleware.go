@@ -1,6 +1,9 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+	"simple-mailer-go/data"
+)
 
 func (app *Config) SessionLoad(next http.Handler) http.Handler {
 	return app.Session.LoadAndSave(next)
@@ -16,3 +19,15 @@ func (app *Config) Auth(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+func (app *Config) Admin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := app.Session.Get(r.Context(), "user").(data.User)
+		if !ok || user.IsAdmin != 1 {
+			app.Session.Put(r.Context(), "error", "You are not allowed to do that.")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// parseTrustedProxies parses proxy addresses, each a single IP or a CIDR
+// range like 10.0.0.0/8.
+func parseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an IP address or CIDR range", entry)
+		}
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
+
+// fromTrustedProxy reports whether r came straight from a trusted proxy.
+func (app *Config) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+	for _, proxy := range app.TrustedProxies {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// baseURL is the public address links sent for r should point at. That is
+// the configured base URL, unless r came through a trusted proxy that says
+// which scheme and host the client used. A forwarded host must be an allowed
+// one: proxies copy the client's Host header, and links with a token in them
+// must not point at whatever host the client made up.
+func (app *Config) baseURL(r *http.Request) string {
+	if !app.fromTrustedProxy(r) {
+		return app.BaseURL
+	}
+
+	base, err := url.Parse(app.BaseURL)
+	if err != nil {
+		return app.BaseURL
+	}
+
+	if proto := forwarded(r, "X-Forwarded-Proto"); proto != "" {
+		switch proto = strings.ToLower(proto); proto {
+		case "http", "https":
+			base.Scheme = proto
+		}
+	}
+	if host := forwarded(r, "X-Forwarded-Host"); host != "" {
+		if u, err := url.Parse("//" + host); err == nil && u.Host == host && u.User == nil && app.allowedHost(base, host) {
+			base.Host = host
+		}
+	}
+
+	return strings.TrimSuffix(base.String(), "/")
+}
+
+// forwarded returns the last value of a forwarded header. Proxies append to
+// these headers, so only the last value was set by the trusted proxy; the
+// ones before it may have come from the client.
+func forwarded(r *http.Request, key string) string {
+	values := r.Header.Values(key)
+	if len(values) == 0 {
+		return ""
+	}
+	last := values[len(values)-1]
+	if i := strings.LastIndex(last, ","); i >= 0 {
+		last = last[i+1:]
+	}
+	return strings.TrimSpace(last)
+}
+
+func (app *Config) allowedHost(base *url.URL, host string) bool {
+	if strings.EqualFold(host, base.Host) {
+		return true
+	}
+	for _, allowed := range app.AllowedHosts {
+		if strings.EqualFold(host, strings.TrimSpace(allowed)) {
+			return true
+		}
+	}
+	return false
+}
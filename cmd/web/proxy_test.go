@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConfig_baseURL(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := Config{BaseURL: "http://localhost:3000", TrustedProxies: proxies, AllowedHosts: []string{"mail.example.com"}}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		proto      string
+		host       string
+		expected   string
+	}{
+		{"direct", "10.1.2.3:4000", "", "", "http://localhost:3000"},
+		{"trusted proxy", "10.1.2.3:4000", "https", "mail.example.com", "https://mail.example.com"},
+		{"trusted ipv6 proxy", "[::1]:4000", "https", "mail.example.com", "https://mail.example.com"},
+		{"proxy chain", "10.1.2.3:4000", "http, https", "proxy.internal, mail.example.com", "https://mail.example.com"},
+		{"client supplied host", "10.1.2.3:4000", "https", "evil.com, mail.example.com", "https://mail.example.com"},
+		{"untrusted client", "203.0.113.9:4000", "https", "evil.com", "http://localhost:3000"},
+		{"host not allowed", "10.1.2.3:4000", "https", "evil.example", "https://localhost:3000"},
+		{"base url host", "10.1.2.3:4000", "", "LOCALHOST:3000", "http://LOCALHOST:3000"},
+		{"bad values", "10.1.2.3:4000", "javascript", "evil.com/path", "http://localhost:3000"},
+	}
+
+	for _, e := range tests {
+		r := httptest.NewRequest("GET", "/register", nil)
+		r.RemoteAddr = e.remoteAddr
+		if e.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", e.proto)
+		}
+		if e.host != "" {
+			r.Header.Set("X-Forwarded-Host", e.host)
+		}
+
+		if got := app.baseURL(r); got != e.expected {
+			t.Errorf("%s: expected %s, got %s", e.name, e.expected, got)
+		}
+	}
+
+	// a proxy that adds its own header line after the client's
+	r := httptest.NewRequest("POST", "/forgot-password", nil)
+	r.RemoteAddr = "10.1.2.3:4000"
+	r.Header.Add("X-Forwarded-Host", "evil.com")
+	r.Header.Add("X-Forwarded-Host", "mail.example.com")
+	if got := app.baseURL(r); got != "http://mail.example.com" {
+		t.Errorf("client header line: expected http://mail.example.com, got %s", got)
+	}
+
+	if _, err := parseTrustedProxies([]string{"proxy.internal"}); err == nil {
+		t.Error("expected a host name to be rejected")
+	}
+}
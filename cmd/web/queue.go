@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"simple-mailer-go/data"
+	"sync"
+	"time"
+)
+
+var errQueueClosed = errors.New("mail queue is closed")
+
+// MailQueue holds outgoing messages until listenForMail picks them up for
+// delivery.
+type MailQueue interface {
+	Push(msg Message) error
+	Messages() <-chan Message
+	Ack(msg Message) error
+	Retry(msg Message, delay time.Duration, err error) error
+	Close() error
+}
+
+// MemoryQueue is the channel based queue. Anything in it, including messages
+// scheduled for later, is lost when the process stops, so it is meant for
+// tests and local development.
+type MemoryQueue struct {
+	messages chan Message
+	done     chan bool
+	mu       sync.Mutex
+	timers   map[*time.Timer]bool
+}
+
+func NewMemoryQueue(size int) *MemoryQueue {
+	return &MemoryQueue{
+		messages: make(chan Message, size),
+		done:     make(chan bool),
+		timers:   make(map[*time.Timer]bool),
+	}
+}
+
+func (q *MemoryQueue) Push(msg Message) error {
+	if delay := time.Until(msg.SendAt); delay > 0 {
+		return q.hold(msg, delay)
+	}
+
+	return q.deliver(msg)
+}
+
+func (q *MemoryQueue) Messages() <-chan Message {
+	return q.messages
+}
+
+func (q *MemoryQueue) Ack(msg Message) error {
+	return nil
+}
+
+func (q *MemoryQueue) Retry(msg Message, delay time.Duration, err error) error {
+	return q.hold(msg, delay)
+}
+
+func (q *MemoryQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for timer := range q.timers {
+		timer.Stop()
+	}
+	close(q.done)
+
+	return nil
+}
+
+func (q *MemoryQueue) deliver(msg Message) error {
+	select {
+	case q.messages <- msg:
+		return nil
+	case <-q.done:
+		return errQueueClosed
+	}
+}
+
+// hold keeps msg back for delay before it is delivered.
+func (q *MemoryQueue) hold(msg Message, delay time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	select {
+	case <-q.done:
+		return errQueueClosed
+	default:
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		delete(q.timers, timer)
+		q.mu.Unlock()
+
+		_ = q.deliver(msg)
+	})
+	q.timers[timer] = true
+
+	return nil
+}
+
+// defaultQueueLease is how long a claimed message belongs to the instance
+// that claimed it. It has to cover the wait on the messages channel as well as
+// the send, or another instance sends the message too.
+const defaultQueueLease = 15 * time.Minute
+
+// PostgresQueue stores messages in the mail_queue table and polls it for
+// work, so queued mail survives restarts. Scheduled messages wait in the table
+// until they are due.
+type PostgresQueue struct {
+	Model    data.MailQueueInterface
+	Interval time.Duration
+	// Lease is how long claimed messages are left to this instance before
+	// any instance may claim them again.
+	Lease    time.Duration
+	errors   chan error
+	messages chan Message
+	wake     chan bool
+	done     chan bool
+	stopped  chan bool
+}
+
+func NewPostgresQueue(model data.MailQueueInterface, size int, interval time.Duration, errorChan chan error) *PostgresQueue {
+	q := &PostgresQueue{
+		Model:    model,
+		Interval: interval,
+		Lease:    defaultQueueLease,
+		errors:   errorChan,
+		messages: make(chan Message, size),
+		wake:     make(chan bool, 1),
+		done:     make(chan bool),
+		stopped:  make(chan bool),
+	}
+
+	go q.poll()
+
+	return q
+}
+
+func (q *PostgresQueue) Push(msg Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	availableAt := msg.SendAt
+	if availableAt.IsZero() {
+		availableAt = time.Now()
+	}
+
+	_, err = q.Model.Insert(payload, availableAt)
+	if err != nil {
+		return err
+	}
+
+	if !availableAt.After(time.Now()) {
+		select {
+		case q.wake <- true:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (q *PostgresQueue) Messages() <-chan Message {
+	return q.messages
+}
+
+func (q *PostgresQueue) Ack(msg Message) error {
+	return q.Model.DeleteByID(msg.QueueID)
+}
+
+func (q *PostgresQueue) Retry(msg Message, delay time.Duration, err error) error {
+	return q.Model.Retry(msg.QueueID, msg.Attempts, err.Error(), time.Now().Add(delay))
+}
+
+// Close stops polling and hands the messages still waiting on the channel
+// back to the table, so the next instance does not have to wait for their
+// lease to run out.
+func (q *PostgresQueue) Close() error {
+	close(q.done)
+	<-q.stopped
+
+	var ids []int
+drain:
+	for {
+		select {
+		case msg := <-q.messages:
+			ids = append(ids, msg.QueueID)
+		default:
+			break drain
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return q.Model.Unclaim(ids)
+}
+
+func (q *PostgresQueue) poll() {
+	defer close(q.stopped)
+
+	ticker := time.NewTicker(q.Interval)
+	defer ticker.Stop()
+
+	for {
+		if !q.claim() {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-q.wake:
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// claim moves pending rows onto the messages channel. It returns false when
+// the queue was closed while waiting for room on the channel.
+func (q *PostgresQueue) claim() bool {
+	rows, err := q.Model.Claim(cap(q.messages), q.Lease)
+	if err != nil {
+		q.report(err)
+		return true
+	}
+
+	for _, row := range rows {
+		var msg Message
+		if err := json.Unmarshal(row.Payload, &msg); err != nil {
+			q.report(fmt.Errorf("dropping unreadable queued mail %d (%s): %w", row.ID, row.Payload, err))
+			_ = q.Model.DeleteByID(row.ID)
+			continue
+		}
+		msg.QueueID = row.ID
+		msg.Attempts = row.Attempts
+
+		select {
+		case q.messages <- msg:
+		case <-q.done:
+			return false
+		}
+	}
+
+	return true
+}
+
+func (q *PostgresQueue) report(err error) {
+	select {
+	case q.errors <- err:
+	case <-q.done:
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"simple-mailer-go/data"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeMailQueueModel struct {
+	mu   sync.Mutex
+	rows map[int]*data.QueuedMail
+	next int
+}
+
+func (f *fakeMailQueueModel) GetAll() ([]*data.QueuedMail, error) {
+	return nil, nil
+}
+
+func (f *fakeMailQueueModel) Insert(payload []byte, availableAt time.Time) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.next++
+	f.rows[f.next] = &data.QueuedMail{ID: f.next, Payload: payload, Status: data.MailQueued, AvailableAt: availableAt}
+	return f.next, nil
+}
+
+func (f *fakeMailQueueModel) Claim(limit int, lease time.Duration) ([]*data.QueuedMail, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	var claimed []*data.QueuedMail
+	for _, row := range f.rows {
+		due := row.Status == data.MailQueued && !row.AvailableAt.After(now)
+		expired := row.Status == data.MailSending && row.LockedUntil != nil && !row.LockedUntil.After(now)
+		if (due || expired) && len(claimed) < limit {
+			lockedUntil := now.Add(lease)
+			row.Status = data.MailSending
+			row.LockedUntil = &lockedUntil
+			claimed = append(claimed, row)
+		}
+	}
+	return claimed, nil
+}
+
+func (f *fakeMailQueueModel) Retry(id, attempts int, lastError string, availableAt time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rows[id].Status = data.MailQueued
+	f.rows[id].Attempts = attempts
+	f.rows[id].LastError = lastError
+	f.rows[id].AvailableAt = availableAt
+	f.rows[id].LockedUntil = nil
+	return nil
+}
+
+func (f *fakeMailQueueModel) Unclaim(ids []int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, id := range ids {
+		f.rows[id].Status = data.MailQueued
+		f.rows[id].LockedUntil = nil
+	}
+	return nil
+}
+
+func (f *fakeMailQueueModel) DeleteByID(id int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.rows, id)
+	return nil
+}
+
+func TestMemoryQueue(t *testing.T) {
+	q := NewMemoryQueue(1)
+
+	_ = q.Push(Message{To: []string{"me@here.com"}})
+	msg := <-q.Messages()
+	if msg.To.String() != "me@here.com" {
+		t.Errorf("expected to receive the pushed message, got %v", msg)
+	}
+}
+
+func TestPostgresQueue(t *testing.T) {
+	model := &fakeMailQueueModel{rows: make(map[int]*data.QueuedMail)}
+	q := NewPostgresQueue(model, 10, time.Hour, make(chan error))
+	defer q.Close()
+
+	err := q.Push(Message{To: []string{"me@here.com"}, Subject: "Queued", Data: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg Message
+	select {
+	case msg = <-q.Messages():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for queued message")
+	}
+
+	if msg.To.String() != "me@here.com" || msg.Subject != "Queued" || msg.Data != "hello" {
+		t.Errorf("message did not survive the round trip: %v", msg)
+	}
+	if msg.QueueID == 0 {
+		t.Error("expected message to carry its queue id")
+	}
+
+	_ = q.Ack(msg)
+	if len(model.rows) != 0 {
+		t.Error("expected acknowledged message to be removed from the queue")
+	}
+}
+
+func TestMemoryQueue_scheduled(t *testing.T) {
+	q := NewMemoryQueue(1)
+	defer q.Close()
+
+	_ = q.Push(Message{To: []string{"me@here.com"}, SendAt: time.Now().Add(100 * time.Millisecond)})
+
+	select {
+	case <-q.Messages():
+		t.Fatal("expected scheduled message to be held back")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	select {
+	case <-q.Messages():
+	case <-time.After(time.Second):
+		t.Fatal("expected scheduled message once it is due")
+	}
+}
+
+func TestPostgresQueue_scheduled(t *testing.T) {
+	model := &fakeMailQueueModel{rows: make(map[int]*data.QueuedMail)}
+	q := NewPostgresQueue(model, 10, 20*time.Millisecond, make(chan error))
+	defer q.Close()
+
+	sendAt := time.Now().Add(100 * time.Millisecond)
+	_ = q.Push(Message{To: []string{"me@here.com"}, SendAt: sendAt})
+
+	model.mu.Lock()
+	stored := model.rows[1].AvailableAt
+	model.mu.Unlock()
+	if !stored.Equal(sendAt) {
+		t.Errorf("expected row to become available at %s, got %s", sendAt, stored)
+	}
+
+	select {
+	case <-q.Messages():
+		if time.Now().Before(sendAt) {
+			t.Error("scheduled message was delivered before it was due")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected scheduled message once it is due")
+	}
+}
+
+func TestPostgresQueue_lease(t *testing.T) {
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Minute)
+	model := &fakeMailQueueModel{rows: map[int]*data.QueuedMail{
+		// still being sent by another instance
+		1: {ID: 1, Payload: []byte(`{"Subject":"leased"}`), Status: data.MailSending, LockedUntil: &future},
+		// left behind by an instance that crashed
+		2: {ID: 2, Payload: []byte(`{"Subject":"expired"}`), Status: data.MailSending, LockedUntil: &past},
+	}}
+	q := NewPostgresQueue(model, 10, time.Hour, make(chan error))
+	defer q.Close()
+
+	select {
+	case msg := <-q.Messages():
+		if msg.Subject != "expired" {
+			t.Errorf("expected the message with the expired lease, got %q", msg.Subject)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the message with the expired lease to be claimed again")
+	}
+
+	select {
+	case msg := <-q.Messages():
+		t.Errorf("expected a message leased to another instance to be left alone, got %q", msg.Subject)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPostgresQueue_Close(t *testing.T) {
+	model := &fakeMailQueueModel{rows: make(map[int]*data.QueuedMail)}
+	q := NewPostgresQueue(model, 10, time.Hour, make(chan error))
+
+	_ = q.Push(Message{Subject: "sent"})
+	_ = q.Push(Message{Subject: "unsent"})
+
+	var sent Message
+	select {
+	case sent = <-q.Messages():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for queued message")
+	}
+
+	// wait for the second message to be claimed as well
+	deadline := time.Now().Add(time.Second)
+	for len(q.messages) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	model.mu.Lock()
+	defer model.mu.Unlock()
+	for id, row := range model.rows {
+		if id == sent.QueueID {
+			if row.Status != data.MailSending {
+				t.Errorf("expected the message taken off the channel to stay claimed, got %s", row.Status)
+			}
+			continue
+		}
+		if row.Status != data.MailQueued || row.LockedUntil != nil {
+			t.Errorf("expected the unsent message to be handed back to the queue, got %s until %v", row.Status, row.LockedUntil)
+		}
+	}
+}
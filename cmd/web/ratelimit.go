@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errRateLimited is returned for a message suppressed by a rate limit.
+var errRateLimited = errors.New("rate limited")
+
+// RateLimit allows Count messages per Window. It is written as "count/window",
+// e.g. "3/15m".
+type RateLimit struct {
+	Count  int
+	Window time.Duration
+}
+
+func parseRateLimit(s string) (RateLimit, error) {
+	count, window, ok := strings.Cut(s, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("rate limit %q must look like 5/1h", s)
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return RateLimit{}, fmt.Errorf("rate limit %q needs a positive count", s)
+	}
+
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return RateLimit{}, fmt.Errorf("rate limit %q needs a positive window like 1h", s)
+	}
+
+	return RateLimit{Count: n, Window: d}, nil
+}
+
+func (r *RateLimit) UnmarshalText(text []byte) error {
+	limit, err := parseRateLimit(string(text))
+	if err != nil {
+		return err
+	}
+	*r = limit
+	return nil
+}
+
+func (r RateLimit) String() string {
+	return fmt.Sprintf("%d/%s", r.Count, r.Window)
+}
+
+// RateLimiter protects recipients from being flooded through the mailer. Per
+// recipient and per template limits suppress messages outright, while the
+// global limit only slows delivery down.
+type RateLimiter struct {
+	PerRecipient RateLimit
+	// PerTemplate limits how often one recipient gets a given template.
+	PerTemplate map[string]RateLimit
+	// GlobalPerSecond caps how many messages are handed to the transport
+	// every second across all workers. Zero means no cap.
+	GlobalPerSecond float64
+
+	mu   sync.Mutex
+	sent map[string]*sentLog
+	next time.Time
+}
+
+type sentLog struct {
+	window time.Duration
+	times  []time.Time
+}
+
+// maxTrackedKeys is how many recipient and template keys are kept before
+// stale ones are swept out.
+const maxTrackedKeys = 10000
+
+// Allow records msg against the limits and returns an error describing the
+// exceeded limit when msg should not be sent.
+func (l *RateLimiter) Allow(msg Message) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.sent == nil {
+		l.sent = make(map[string]*sentLog)
+	}
+	now := time.Now()
+
+	if len(l.sent) > maxTrackedKeys {
+		for key, log := range l.sent {
+			l.count(key, log.window, now)
+		}
+	}
+
+	template := msg.Template
+	if template == "" {
+		template = "mail"
+	}
+
+	limits := make(map[string]RateLimit)
+	for _, recipient := range msg.recipients() {
+		recipient = strings.ToLower(recipient)
+
+		if l.PerRecipient.Count > 0 {
+			key := "recipient:" + recipient
+			if l.count(key, l.PerRecipient.Window, now) >= l.PerRecipient.Count {
+				return fmt.Errorf("%s already got %s messages", recipient, l.PerRecipient)
+			}
+			limits[key] = l.PerRecipient
+		}
+
+		if limit, ok := l.PerTemplate[template]; ok {
+			key := "template:" + template + ":" + recipient
+			if l.count(key, limit.Window, now) >= limit.Count {
+				return fmt.Errorf("%s already got %s %q messages", recipient, limit, template)
+			}
+			limits[key] = limit
+		}
+	}
+
+	for key, limit := range limits {
+		if l.sent[key] == nil {
+			l.sent[key] = &sentLog{window: limit.Window}
+		}
+		l.sent[key].times = append(l.sent[key].times, now)
+	}
+
+	return nil
+}
+
+// count drops entries older than window for key and returns how many are
+// left.
+func (l *RateLimiter) count(key string, window time.Duration, now time.Time) int {
+	log, ok := l.sent[key]
+	if !ok {
+		return 0
+	}
+
+	i := 0
+	for i < len(log.times) && now.Sub(log.times[i]) >= window {
+		i++
+	}
+	log.times = log.times[i:]
+
+	if len(log.times) == 0 {
+		delete(l.sent, key)
+	}
+
+	return len(log.times)
+}
+
+// Wait blocks until the global limit allows another message to go out and
+// returns how long it waited.
+func (l *RateLimiter) Wait() time.Duration {
+	if l.GlobalPerSecond <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(time.Second) / l.GlobalPerSecond))
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+	return delay
+}
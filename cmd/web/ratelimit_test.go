@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := parseRateLimit("3/15m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit.Count != 3 || limit.Window != 15*time.Minute {
+		t.Errorf("unexpected limit %s", limit)
+	}
+
+	for _, s := range []string{"3", "0/1h", "x/1h", "3/soon", "3/-1m"} {
+		if _, err := parseRateLimit(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestRateLimiter_Allow(t *testing.T) {
+	limiter := RateLimiter{
+		PerRecipient: RateLimit{Count: 3, Window: time.Hour},
+		PerTemplate: map[string]RateLimit{
+			"failed-login": {Count: 2, Window: time.Hour},
+		},
+	}
+	failedLogin := Message{To: []string{"me@here.com"}, Template: "failed-login"}
+
+	for i := 0; i < 2; i++ {
+		if err := limiter.Allow(failedLogin); err != nil {
+			t.Fatalf("message %d should be allowed: %s", i+1, err)
+		}
+	}
+
+	err := limiter.Allow(failedLogin)
+	if err == nil || !strings.Contains(err.Error(), "failed-login") {
+		t.Errorf("expected the template limit to kick in, got %v", err)
+	}
+
+	// Addresses are compared case insensitively.
+	if err := limiter.Allow(Message{To: []string{"ME@here.com"}}); err != nil {
+		t.Errorf("other templates should still be allowed: %s", err)
+	}
+	if err := limiter.Allow(Message{To: []string{"me@here.com"}}); err == nil {
+		t.Error("expected the recipient limit to kick in")
+	}
+
+	// A rejected message is not recorded against the other recipients.
+	if err := limiter.Allow(Message{To: []string{"you@here.com"}, Cc: []string{"me@here.com"}}); err == nil {
+		t.Error("expected the recipient limit to apply to cc")
+	}
+	for i := 0; i < 3; i++ {
+		if err := limiter.Allow(Message{To: []string{"you@here.com"}}); err != nil {
+			t.Fatalf("message %d to another recipient should be allowed: %s", i+1, err)
+		}
+	}
+}
+
+func TestRateLimiter_Window(t *testing.T) {
+	limiter := RateLimiter{PerRecipient: RateLimit{Count: 1, Window: 50 * time.Millisecond}}
+	msg := Message{To: []string{"me@here.com"}}
+
+	if err := limiter.Allow(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := limiter.Allow(msg); err == nil {
+		t.Fatal("expected the second message to be suppressed")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := limiter.Allow(msg); err != nil {
+		t.Errorf("expected the limit to reset after the window: %s", err)
+	}
+}
+
+func TestRateLimiter_Wait(t *testing.T) {
+	limiter := RateLimiter{GlobalPerSecond: 100}
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		limiter.Wait()
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected 5 messages at 100/s to take at least 40ms, took %s", elapsed)
+	}
+}
+
+func TestConfig_sendEmail_suppressed(t *testing.T) {
+	app := testApp
+	app.Mailer.Limiter = &RateLimiter{PerRecipient: RateLimit{Count: 1, Window: time.Hour}}
+	msg := Message{To: []string{"limited@here.com"}, Subject: "Hi", Data: "hello"}
+
+	testTransport.Reset()
+	if err := app.sendEmail(msg); err != nil {
+		t.Fatal(err)
+	}
+	waitForMail(t, 1)
+
+	if err := app.sendEmail(msg); err == nil {
+		t.Error("expected the second message to be suppressed")
+	}
+}
@@ -1,15 +1,137 @@
 package main
 
 import (
+	"embed"
+	"errors"
 	"fmt"
 	"html/template"
+	"io/fs"
 	"net/http"
+	"os"
 	"simple-mailer-go/data"
+	"sync"
 	"time"
 )
 
 var pathToTemplates = "./cmd/web/templates"
 
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// templatesFS returns the templates compiled into the binary, or in dev mode
+// the files under pathToTemplates so edits show up without a rebuild.
+func templatesFS(dev bool) fs.FS {
+	if dev {
+		return os.DirFS(pathToTemplates)
+	}
+
+	sub, err := fs.Sub(embeddedTemplates, "templates")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// modifiedSince reports whether any file or directory in fsys changed after t.
+func modifiedSince(fsys fs.FS, t time.Time) (bool, error) {
+	changed := false
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(t) {
+			changed = true
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return changed, err
+}
+
+// pageLayouts are parsed along with every page.
+var pageLayouts = []string{
+	"base.layout.gohtml",
+	"header.partial.gohtml",
+	"navbar.partial.gohtml",
+	"footer.partial.gohtml",
+	"alerts.partial.gohtml",
+}
+
+// PageTemplates holds every *.page.gohtml template parsed with the layouts,
+// keyed by file name.
+type PageTemplates struct {
+	FS fs.FS
+	// Reload parses the templates again when a file in FS has changed.
+	Reload bool
+
+	mu     sync.RWMutex
+	loaded time.Time
+	pages  map[string]*template.Template
+}
+
+func NewPageTemplates(fsys fs.FS, reload bool) (*PageTemplates, error) {
+	t := &PageTemplates{FS: fsys, Reload: reload}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *PageTemplates) load() error {
+	loaded := time.Now()
+
+	files, err := fs.Glob(t.FS, "*.page.gohtml")
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("no page templates found")
+	}
+
+	pages := make(map[string]*template.Template)
+	for _, file := range files {
+		tmpl, err := template.New(file).Funcs(templateFuncs).ParseFS(t.FS, append([]string{file}, pageLayouts...)...)
+		if err != nil {
+			return err
+		}
+		pages[file] = tmpl
+	}
+
+	t.mu.Lock()
+	t.loaded, t.pages = loaded, pages
+	t.mu.Unlock()
+
+	return nil
+}
+
+// Lookup returns the named page.
+func (t *PageTemplates) Lookup(name string) (*template.Template, error) {
+	if t.Reload {
+		t.mu.RLock()
+		loaded := t.loaded
+		t.mu.RUnlock()
+
+		if changed, err := modifiedSince(t.FS, loaded); err != nil || changed {
+			if err := t.load(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	tmpl, ok := t.pages[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown page template %q", name)
+	}
+	return tmpl, nil
+}
+
 type TemplateData struct {
 	StringMap     map[string]string
 	IntMap        map[string]int
@@ -21,27 +143,18 @@ type TemplateData struct {
 	Authenticated bool
 	Now           time.Time
 	User          *data.User
+	Language      string
 }
 
 func (app *Config) render(w http.ResponseWriter, r *http.Request, t string, td *TemplateData) {
-	partials := []string{
-		fmt.Sprintf("%s/base.layout.gohtml", pathToTemplates),
-		fmt.Sprintf("%s/header.partial.gohtml", pathToTemplates),
-		fmt.Sprintf("%s/navbar.partial.gohtml", pathToTemplates),
-		fmt.Sprintf("%s/footer.partial.gohtml", pathToTemplates),
-		fmt.Sprintf("%s/alerts.partial.gohtml", pathToTemplates),
-	}
-
-	var templateSlice []string
-	templateSlice = append(templateSlice, fmt.Sprintf("%s/%s", pathToTemplates, t))
-
-	templateSlice = append(templateSlice, partials...)
-
 	if td == nil {
 		td = &TemplateData{}
 	}
 
-	tmpl, err := template.ParseFiles(templateSlice...)
+	tmpl, err := app.Templates.Lookup(t)
+	if err == nil {
+		tmpl, err = localize(tmpl, app.translator(r))
+	}
 	if err != nil {
 		app.ErrorLog.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -56,9 +169,11 @@ func (app *Config) render(w http.ResponseWriter, r *http.Request, t string, td *
 }
 
 func (app *Config) AddDefaultData(td *TemplateData, r *http.Request) *TemplateData {
-	td.Flash = app.Session.PopString(r.Context(), "flash")
-	td.Warning = app.Session.PopString(r.Context(), "warning")
-	td.Error = app.Session.PopString(r.Context(), "error")
+	tr := app.translator(r)
+	td.Language = tr.Language
+	td.Flash = tr.T(app.Session.PopString(r.Context(), "flash"))
+	td.Warning = tr.T(app.Session.PopString(r.Context(), "warning"))
+	td.Error = tr.T(app.Session.PopString(r.Context(), "error"))
 	if app.IsAuthenticated(r) {
 		td.Authenticated = true
 		user, ok := app.Session.Get(r.Context(), "user").(data.User)
@@ -74,6 +189,15 @@ func (app *Config) AddDefaultData(td *TemplateData, r *http.Request) *TemplateDa
 	return td
 }
 
+// translator picks the logged in user's language, or the best match for the
+// browser's Accept-Language header.
+func (app *Config) translator(r *http.Request) *Translator {
+	if user, ok := app.Session.Get(r.Context(), "user").(data.User); ok && user.Language != "" {
+		return app.Locales.Translator(user.Language)
+	}
+	return app.Locales.Translator(app.Locales.MatchAcceptLanguage(r.Header.Get("Accept-Language")))
+}
+
 func (app *Config) IsAuthenticated(r *http.Request) bool {
 	return app.Session.Exists(r.Context(), "userID")
 }
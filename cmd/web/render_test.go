@@ -3,7 +3,11 @@ package main
 import (
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
 	"testing"
+	"testing/fstest"
 )
 
 func TestConfig_AddDefaultData(t *testing.T) {
@@ -50,8 +54,6 @@ func TestConfig_IsAuthenticated(t *testing.T) {
 }
 
 func TestConfig_Render(t *testing.T) {
-	pathToTemplates = "./templates"
-
 	w := httptest.NewRecorder()
 
 	r, _ := http.NewRequest("GET", "/", nil)
@@ -63,3 +65,48 @@ func TestConfig_Render(t *testing.T) {
 		t.Error("Render did not return a 200")
 	}
 }
+
+func TestConfig_Render_unknownPage(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	ctx := getCtx(r)
+	r = r.WithContext(ctx)
+
+	testApp.render(w, r, "missing.page.gohtml", &TemplateData{})
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected a 500 for an unknown page, got %d", w.Code)
+	}
+}
+
+func TestNewPageTemplates_missingPartial(t *testing.T) {
+	fsys := fstest.MapFS{
+		"home.page.gohtml":   {Data: []byte(`{{template "base" .}}`)},
+		"base.layout.gohtml": {Data: []byte(`{{define "base"}}{{template "header" .}}{{end}}`)},
+	}
+
+	_, err := NewPageTemplates(fsys, false)
+	if err == nil || !strings.Contains(err.Error(), "header.partial.gohtml") {
+		t.Errorf("expected an error about the missing partial, got %v", err)
+	}
+}
+
+// Every page the handlers render must be in the cache, or it would only show
+// up as a 500 at request time.
+func TestPageTemplates_handlerPages(t *testing.T) {
+	source, err := os.ReadFile("handlers.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages := regexp.MustCompile(`"([\w-]+\.page\.gohtml)"`).FindAllStringSubmatch(string(source), -1)
+	if len(pages) == 0 {
+		t.Fatal("no pages found in handlers.go")
+	}
+
+	for _, page := range pages {
+		if _, err := testApp.Templates.Lookup(page[1]); err != nil {
+			t.Error(err)
+		}
+	}
+}
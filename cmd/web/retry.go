@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy decides how often and how far apart a failed message is retried
+// before it is moved to the dead letter store.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Jitter is the fraction of the delay that is randomised, so that messages
+	// failing together do not all retry at the same moment.
+	Jitter float64
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   30 * time.Second,
+	MaxDelay:    30 * time.Minute,
+	Jitter:      0.2,
+}
+
+// Backoff returns how long to wait after the given failed attempt, starting
+// at 1. The delay doubles with every attempt up to MaxDelay.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	delay := float64(p.BaseDelay) * math.Pow(2, float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(delay)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   time.Second,
+		MaxDelay:    10 * time.Second,
+	}
+
+	tests := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+	}
+
+	for _, e := range tests {
+		if d := policy.Backoff(e.attempt); d != e.expected {
+			t.Errorf("attempt %d: expected %s, got %s", e.attempt, e.expected, d)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := policy.Backoff(2)
+		if d < time.Second || d > 3*time.Second {
+			t.Errorf("jittered delay %s outside of expected range", d)
+		}
+	}
+}
+
+func TestMail_fail(t *testing.T) {
+	queue := NewMemoryQueue(1)
+	defer queue.Close()
+
+	m := Mail{
+		Queue:       queue,
+		RetryPolicy: RetryPolicy{MaxAttempts: 2},
+		DeadLetters: testApp.Models.DeadLetter,
+		Log:         testApp.Models.MailLog,
+	}
+	errorChan := make(chan error, 10)
+
+	m.fail(Message{To: []string{"me@here.com"}}, errors.New("connection refused"), errorChan)
+
+	select {
+	case msg := <-queue.Messages():
+		if msg.Attempts != 1 {
+			t.Errorf("expected retried message to record 1 attempt, got %d", msg.Attempts)
+		}
+		m.fail(msg, errors.New("connection refused"), errorChan)
+	case <-time.After(time.Second):
+		t.Fatal("expected failed message to be retried")
+	}
+
+	select {
+	case <-queue.Messages():
+		t.Error("expected message to be dead lettered after the last attempt")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if len(errorChan) != 2 {
+		t.Errorf("expected 2 reported errors, got %d", len(errorChan))
+	}
+}
@@ -21,8 +21,16 @@ func (app *Config) routes() http.Handler {
 	mux.Get("/register", app.RegisterPage)
 	mux.Post("/register", app.PostRegisterPage)
 	mux.Get("/activate", app.ActivateAccount)
+	mux.Post("/activate/resend", app.ResendActivation)
+	mux.Get("/forgot-password", app.ForgotPasswordPage)
+	mux.Post("/forgot-password", app.PostForgotPasswordPage)
+	mux.Get("/reset-password", app.ResetPasswordPage)
+	mux.Post("/reset-password", app.PostResetPasswordPage)
+	mux.Get("/mail/open/{id}", app.TrackOpen)
+	mux.Get("/mail/click/{id}", app.TrackClick)
 
 	mux.Mount("/members", app.authRouter())
+	mux.Mount("/admin", app.adminRouter())
 	return mux
 }
 
@@ -33,3 +41,14 @@ func (app *Config) authRouter() http.Handler {
 	mux.Get("/subscribe", app.SubscribeToPlan)
 	return mux
 }
+
+func (app *Config) adminRouter() http.Handler {
+	mux := chi.NewRouter()
+	mux.Use(app.Auth)
+	mux.Use(app.Admin)
+	mux.Get("/mail/dead-letters", app.DeadLetters)
+	mux.Post("/mail/dead-letters/replay", app.ReplayDeadLetter)
+	mux.Get("/mail/preview", app.PreviewMail)
+	mux.Get("/mail/preview/{template}", app.PreviewMail)
+	return mux
+}
@@ -12,8 +12,17 @@ var routes = []string{
 	"/login",
 	"/register",
 	"/activate",
+	"/activate/resend",
+	"/forgot-password",
+	"/reset-password",
+	"/mail/open/{id}",
+	"/mail/click/{id}",
 	"/members/plans",
 	"/members/subscribe",
+	"/admin/mail/dead-letters",
+	"/admin/mail/dead-letters/replay",
+	"/admin/mail/preview",
+	"/admin/mail/preview/{template}",
 }
 
 func Test_Routes_exist(t *testing.T) {
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// MailSettings configures the mailer. Values are read from an optional YAML
+// file first and can then be overridden with environment variables.
+type MailSettings struct {
+	Domain                string               `yaml:"domain"`
+	Host                  string               `yaml:"host"`
+	Port                  int                  `yaml:"port"`
+	Username              string               `yaml:"username"`
+	Password              string               `yaml:"password"`
+	Encryption            string               `yaml:"encryption"`
+	FromName              string               `yaml:"from_name"`
+	FromAddress           string               `yaml:"from_address"`
+	BaseURL               string               `yaml:"base_url"`
+	Queue                 string               `yaml:"queue"`
+	Transport             string               `yaml:"transport"`
+	DropDir               string               `yaml:"drop_dir"`
+	Workers               int                  `yaml:"workers"`
+	MessagesPerConnection int                  `yaml:"messages_per_connection"`
+	MaxAttempts           int                  `yaml:"max_attempts"`
+	RetryDelay            time.Duration        `yaml:"retry_delay"`
+	MaxRetryDelay         time.Duration        `yaml:"max_retry_delay"`
+	DKIM                  []DKIMSettings       `yaml:"dkim"`
+	RateLimitPerRecipient RateLimit            `yaml:"rate_limit_per_recipient"`
+	RateLimitTemplates    map[string]RateLimit `yaml:"rate_limit_templates"`
+	RateLimitGlobal       float64              `yaml:"rate_limit_global"`
+	Lint                  bool                 `yaml:"lint"`
+	Tracking              bool                 `yaml:"tracking"`
+	ActivationLinkExpiry  time.Duration        `yaml:"activation_link_expiry"`
+	ResetLinkExpiry       time.Duration        `yaml:"password_reset_link_expiry"`
+	// TrustedProxies may set X-Forwarded-Proto and X-Forwarded-Host to
+	// change the base url of links sent in response to a request.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// AllowedHosts are the hosts besides base_url's that a trusted proxy may
+	// forward. Proxies copy the client's Host header, so any other host is
+	// ignored rather than put in a link.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+	// SigningKeys sign the links in emails. The first one signs new links
+	// and the others only verify, while links signed with them expire.
+	SigningKeys []SigningKey `yaml:"signing_keys"`
+
+	// DKIMKeys holds the loaded DKIM keys by domain.
+	DKIMKeys map[string]DKIMKey `yaml:"-"`
+	// Proxies holds the parsed trusted proxies.
+	Proxies []netip.Prefix `yaml:"-"`
+	// Signer signs links with SigningKeys.
+	Signer *URLSigner `yaml:"-"`
+}
+
+// defaultMailSettings returns the settings used where the file and the
+// environment do not say otherwise. Each call gets its own maps, so loading a
+// file never changes the defaults.
+func defaultMailSettings() MailSettings {
+	return MailSettings{
+		Domain:                "localhost",
+		Host:                  "localhost",
+		Port:                  1025,
+		Encryption:            "none",
+		FromName:              "Info",
+		FromAddress:           "info@localhost",
+		BaseURL:               "http://localhost:3000",
+		Queue:                 "postgres",
+		Transport:             "smtp",
+		Workers:               4,
+		MessagesPerConnection: 50,
+		MaxAttempts:           defaultRetryPolicy.MaxAttempts,
+		RetryDelay:            defaultRetryPolicy.BaseDelay,
+		MaxRetryDelay:         defaultRetryPolicy.MaxDelay,
+		RateLimitPerRecipient: RateLimit{Count: 20, Window: time.Hour},
+		RateLimitTemplates: map[string]RateLimit{
+			"failed-login":       {Count: 3, Window: 15 * time.Minute},
+			"confirmation-email": {Count: 3, Window: time.Hour},
+			"password-reset":     {Count: 3, Window: time.Hour},
+		},
+		RateLimitGlobal:      10,
+		ActivationLinkExpiry: 24 * time.Hour,
+		ResetLinkExpiry:      time.Hour,
+	}
+}
+
+// loadMailSettings reads the settings from path, when given, and from the
+// environment, and validates the result.
+func loadMailSettings(path string) (MailSettings, error) {
+	settings := defaultMailSettings()
+
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return settings, fmt.Errorf("reading mail config: %w", err)
+		}
+
+		// decoding into a map merges with what is there, so the file's
+		// template limits replace the defaults rather than adding to them
+		templates := settings.RateLimitTemplates
+		settings.RateLimitTemplates = nil
+		if err = yaml.Unmarshal(content, &settings); err != nil {
+			return settings, fmt.Errorf("parsing mail config %s: %w", path, err)
+		}
+		if settings.RateLimitTemplates == nil {
+			settings.RateLimitTemplates = templates
+		}
+	}
+
+	if err := settings.fromEnv(); err != nil {
+		return settings, err
+	}
+
+	settings.BaseURL = strings.TrimSuffix(settings.BaseURL, "/")
+
+	if err := settings.validate(); err != nil {
+		return settings, err
+	}
+
+	settings.Proxies, _ = parseTrustedProxies(settings.TrustedProxies)
+	settings.Signer, _ = NewURLSigner(settings.SigningKeys)
+
+	settings.DKIMKeys = make(map[string]DKIMKey)
+	for _, entry := range settings.DKIM {
+		key, err := loadDKIMKey(entry)
+		if err != nil {
+			return settings, err
+		}
+		settings.DKIMKeys[key.Domain] = key
+	}
+
+	return settings, nil
+}
+
+func (s *MailSettings) fromEnv() error {
+	stringVars := map[string]*string{
+		"MAIL_DOMAIN":       &s.Domain,
+		"MAIL_HOST":         &s.Host,
+		"MAIL_USERNAME":     &s.Username,
+		"MAIL_PASSWORD":     &s.Password,
+		"MAIL_ENCRYPTION":   &s.Encryption,
+		"MAIL_FROM_NAME":    &s.FromName,
+		"MAIL_FROM_ADDRESS": &s.FromAddress,
+		"BASE_URL":          &s.BaseURL,
+		"MAIL_QUEUE":        &s.Queue,
+		"MAIL_TRANSPORT":    &s.Transport,
+		"MAIL_DROP_DIR":     &s.DropDir,
+	}
+	for key, field := range stringVars {
+		if v, ok := os.LookupEnv(key); ok {
+			*field = v
+		}
+	}
+
+	intVars := map[string]*int{
+		"MAIL_PORT":                    &s.Port,
+		"MAIL_WORKERS":                 &s.Workers,
+		"MAIL_MESSAGES_PER_CONNECTION": &s.MessagesPerConnection,
+		"MAIL_MAX_ATTEMPTS":            &s.MaxAttempts,
+	}
+	for key, field := range intVars {
+		if v, ok := os.LookupEnv(key); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s must be a number, got %q", key, v)
+			}
+			*field = n
+		}
+	}
+
+	durationVars := map[string]*time.Duration{
+		"MAIL_RETRY_DELAY":           &s.RetryDelay,
+		"MAIL_MAX_RETRY_DELAY":       &s.MaxRetryDelay,
+		"ACTIVATION_LINK_EXPIRY":     &s.ActivationLinkExpiry,
+		"PASSWORD_RESET_LINK_EXPIRY": &s.ResetLinkExpiry,
+	}
+	for key, field := range durationVars {
+		if v, ok := os.LookupEnv(key); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%s must be a duration like 30s, got %q", key, v)
+			}
+			*field = d
+		}
+	}
+
+	if v, ok := os.LookupEnv("MAIL_RATE_LIMIT_PER_RECIPIENT"); ok {
+		limit, err := parseRateLimit(v)
+		if err != nil {
+			return fmt.Errorf("MAIL_RATE_LIMIT_PER_RECIPIENT: %w", err)
+		}
+		s.RateLimitPerRecipient = limit
+	}
+
+	if v, ok := os.LookupEnv("MAIL_RATE_LIMIT_GLOBAL"); ok {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("MAIL_RATE_LIMIT_GLOBAL must be a number, got %q", v)
+		}
+		s.RateLimitGlobal = n
+	}
+
+	boolVars := map[string]*bool{
+		"MAIL_LINT":     &s.Lint,
+		"MAIL_TRACKING": &s.Tracking,
+	}
+	for key, field := range boolVars {
+		if v, ok := os.LookupEnv(key); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("%s must be true or false, got %q", key, v)
+			}
+			*field = b
+		}
+	}
+
+	// URL_SIGNING_KEYS lists id:secret pairs, current key first
+	if v, ok := os.LookupEnv("URL_SIGNING_KEYS"); ok {
+		s.SigningKeys = nil
+		for _, pair := range strings.Split(v, ",") {
+			id, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok {
+				return errors.New("URL_SIGNING_KEYS must be a list of id:secret pairs")
+			}
+			s.SigningKeys = append(s.SigningKeys, SigningKey{ID: id, Secret: secret})
+		}
+	}
+	// the key from before key IDs still verifies, and signs when it is alone
+	if v := os.Getenv("EMAIL_SIGNER_SECRET_KEY"); v != "" {
+		s.SigningKeys = append(s.SigningKeys, SigningKey{ID: "default", Secret: v})
+	}
+
+	if v, ok := os.LookupEnv("TRUSTED_PROXIES"); ok {
+		s.TrustedProxies = strings.Split(v, ",")
+	}
+
+	if v, ok := os.LookupEnv("ALLOWED_HOSTS"); ok {
+		s.AllowedHosts = strings.Split(v, ",")
+	}
+
+	if domain := os.Getenv("MAIL_DKIM_DOMAIN"); domain != "" {
+		s.DKIM = append(s.DKIM, DKIMSettings{
+			Domain:         domain,
+			Selector:       os.Getenv("MAIL_DKIM_SELECTOR"),
+			PrivateKeyPath: os.Getenv("MAIL_DKIM_PRIVATE_KEY_PATH"),
+		})
+	}
+
+	return nil
+}
+
+func (s MailSettings) validate() error {
+	var errs []error
+
+	switch s.Transport {
+	case "smtp":
+		if s.Host == "" {
+			errs = append(errs, errors.New("mail host is required"))
+		}
+		if s.Port < 1 || s.Port > 65535 {
+			errs = append(errs, fmt.Errorf("mail port %d is out of range", s.Port))
+		}
+		switch s.Encryption {
+		case "none", "tls", "ssl":
+		default:
+			errs = append(errs, fmt.Errorf("mail encryption must be none, tls or ssl, got %q", s.Encryption))
+		}
+		if (s.Username == "") != (s.Password == "") {
+			errs = append(errs, errors.New("mail username and password must be set together"))
+		}
+	case "file", "memory":
+	default:
+		errs = append(errs, fmt.Errorf("mail transport must be smtp, file or memory, got %q", s.Transport))
+	}
+
+	switch s.Queue {
+	case "postgres", "memory":
+	default:
+		errs = append(errs, fmt.Errorf("mail queue must be postgres or memory, got %q", s.Queue))
+	}
+
+	if _, err := mail.ParseAddress(s.FromAddress); err != nil {
+		errs = append(errs, fmt.Errorf("mail from address %q is invalid: %w", s.FromAddress, err))
+	}
+
+	u, err := url.Parse(s.BaseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("base url %q must be an absolute http or https url", s.BaseURL))
+	}
+
+	if s.Workers < 1 {
+		errs = append(errs, errors.New("mail workers must be at least 1"))
+	}
+	if s.MessagesPerConnection < 0 {
+		errs = append(errs, errors.New("mail messages per connection cannot be negative"))
+	}
+	if s.MaxAttempts < 1 {
+		errs = append(errs, errors.New("mail max attempts must be at least 1"))
+	}
+	if s.RateLimitGlobal < 0 {
+		errs = append(errs, errors.New("mail global rate limit cannot be negative"))
+	}
+	if _, err := parseTrustedProxies(s.TrustedProxies); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := NewURLSigner(s.SigningKeys); err != nil {
+		errs = append(errs, err)
+	}
+	if s.ActivationLinkExpiry < time.Minute {
+		errs = append(errs, errors.New("activation link expiry must be at least 1m"))
+	}
+	if s.ResetLinkExpiry < time.Minute {
+		errs = append(errs, errors.New("password reset link expiry must be at least 1m"))
+	}
+
+	return errors.Join(errs...)
+}
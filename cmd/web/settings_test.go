@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadMailSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.yml")
+	_ = os.WriteFile(path, []byte(`
+host: smtp.example.com
+port: 587
+username: mailer
+password: secret
+encryption: tls
+from_address: noreply@example.com
+base_url: https://example.com
+retry_delay: 1m
+`), 0644)
+
+	t.Setenv("MAIL_PORT", "2525")
+	t.Setenv("URL_SIGNING_KEYS", "new:"+strings.Repeat("n", 32)+",old:"+strings.Repeat("o", 32))
+
+	settings, err := loadMailSettings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if settings.Host != "smtp.example.com" {
+		t.Errorf("expected host from file, got %s", settings.Host)
+	}
+	if settings.Port != 2525 {
+		t.Errorf("expected port from environment, got %d", settings.Port)
+	}
+	if settings.RetryDelay != time.Minute {
+		t.Errorf("expected retry delay from file, got %s", settings.RetryDelay)
+	}
+	if settings.FromName != "Info" {
+		t.Errorf("expected default from name, got %s", settings.FromName)
+	}
+	if len(settings.SigningKeys) != 2 || settings.SigningKeys[0].ID != "new" || settings.Signer == nil {
+		t.Errorf("expected signing keys from environment, got %v", settings.SigningKeys)
+	}
+}
+
+func TestLoadMailSettings_rateLimitTemplates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.yml")
+	_ = os.WriteFile(path, []byte(`
+rate_limit_templates:
+  invoice: 1/1h
+`), 0644)
+	t.Setenv("URL_SIGNING_KEYS", "test:"+strings.Repeat("t", 32))
+
+	settings, err := loadMailSettings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(settings.RateLimitTemplates) != 1 || settings.RateLimitTemplates["invoice"].Count != 1 {
+		t.Errorf("expected the file's limits to replace the defaults, got %v", settings.RateLimitTemplates)
+	}
+	if defaults := defaultMailSettings().RateLimitTemplates; len(defaults) != 3 || defaults["invoice"].Count != 0 {
+		t.Errorf("expected loading a file to leave the defaults alone, got %v", defaults)
+	}
+
+	settings, err = loadMailSettings("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.RateLimitTemplates["failed-login"].Count != 3 {
+		t.Errorf("expected the default limits without a file, got %v", settings.RateLimitTemplates)
+	}
+}
+
+func TestLoadMailSettings_invalid(t *testing.T) {
+	t.Setenv("MAIL_ENCRYPTION", "starttls")
+	t.Setenv("MAIL_FROM_ADDRESS", "not an address")
+	t.Setenv("BASE_URL", "localhost:3000")
+
+	_, err := loadMailSettings("")
+	if err == nil {
+		t.Fatal("expected invalid settings to fail")
+	}
+
+	for _, expected := range []string{"encryption", "from address", "base url", "no url signing key"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to mention %s, got: %s", expected, err)
+		}
+	}
+
+	t.Setenv("MAIL_PORT", "smtp")
+	if _, err = loadMailSettings(""); err == nil || !strings.Contains(err.Error(), "MAIL_PORT") {
+		t.Errorf("expected a non numeric port to be rejected, got %v", err)
+	}
+}
@@ -15,6 +15,9 @@ import (
 )
 
 var testApp Config
+var testTransport = NewMemoryTransport()
+
+var testSigningKey = SigningKey{ID: "test", Secret: "a-test-secret-of-at-least-32-characters"}
 
 func TestMain(m *testing.M) {
 	gob.Register(data.User{})
@@ -22,13 +25,35 @@ func TestMain(m *testing.M) {
 
 	tmpPath = "./../../tmp"
 	pathToManual = "./../../pdf"
+	pathToTemplates = "./templates"
 	session := scs.New()
 	session.Lifetime = 24 * time.Hour
 	session.Cookie.Persist = true
 	session.Cookie.SameSite = http.SameSiteLaxMode
 	session.Cookie.Secure = true
 
+	pageTemplates, err := NewPageTemplates(templatesFS(false), false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mailTemplates, err := NewMailTemplates(templatesFS(false), false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	locales, err := LoadLocales(localesFS(), defaultLanguage)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	signer, err := NewURLSigner([]SigningKey{testSigningKey})
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	wait := &sync.WaitGroup{}
+	models := data.TestNew(nil)
 	testApp = Config{
 		Session:   session,
 		DB:        nil,
@@ -37,26 +62,31 @@ func TestMain(m *testing.M) {
 		Wait:      wait,
 		ErrorChan: make(chan error),
 		DoneChan:  make(chan bool),
-		Models:    data.TestNew(nil),
+		Models:    models,
+		Templates: pageTemplates,
+		Locales:   locales,
+		BaseURL:   "http://localhost:3000",
 		Mailer: Mail{
-			Wait:       wait,
-			DoneChan:   make(chan bool),
-			ErrorChan:  make(chan error),
-			MailerChan: make(chan Message, 100),
+			FromName:    "Info",
+			FromAddress: "info@localhost",
+			DoneChan:    make(chan bool),
+			ErrorChan:   make(chan error),
+			Templates:   mailTemplates,
+			Locales:     locales,
+			Transport:   testTransport,
+			Queue:       NewMemoryQueue(100),
+			RetryPolicy: defaultRetryPolicy,
+			DeadLetters: models.DeadLetter,
+			Log:         models.MailLog,
+			Signer:      signer,
 		},
+
+		ActivationExpiry: 24 * time.Hour,
+		ResetExpiry:      time.Hour,
+		Signer:           signer,
 	}
 
-	go func() {
-		for {
-			select {
-			case <-testApp.Mailer.MailerChan:
-				testApp.Wait.Done()
-			case <-testApp.Mailer.ErrorChan:
-			case <-testApp.Mailer.DoneChan:
-				return
-			}
-		}
-	}()
+	go testApp.listenForMail()
 
 	go func() {
 		for {
@@ -72,6 +102,22 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+// waitForMail waits until the test transport has captured n messages.
+func waitForMail(t *testing.T, n int) []SentMail {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if sent := testTransport.Sent(); len(sent) >= n {
+			return sent
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("expected %d sent messages, got %d", n, len(testTransport.Sent()))
+	return nil
+}
+
 func getCtx(r *http.Request) context.Context {
 	ctx, err := testApp.Session.Load(r.Context(), r.Header.Get("X-Session"))
 	if err != nil {
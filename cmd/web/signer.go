@@ -1,48 +1,140 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"net/url"
+	"regexp"
 	"strings"
 	"time"
 
 	goalone "github.com/bwmarrin/go-alone"
 )
 
-var secret = os.Getenv("EMAIL_SIGNER_SECRET_KEY")
+// minSigningKeyLength is the shortest secret a signing key may have.
+const minSigningKeyLength = 32
 
-var secretKey []byte
+var signingKeyID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
 
-func NewURLSigner() {
+// SigningKey is a secret that signs links, known by an ID that signed links
+// carry so the key can be found again.
+type SigningKey struct {
+	ID     string `yaml:"id"`
+	Secret string `yaml:"secret"`
+}
 
-	secretKey = []byte(secret)
+// URLSigner signs links with the current key and verifies them with any
+// configured key, so a key can be rotated out without breaking the links
+// already sent.
+type URLSigner struct {
+	current string
+	keys    map[string][]byte
 }
 
-func GenerateTokenFromString(data string) string {
-	var urlToSign string
+// NewURLSigner returns a signer for keys, the first of which is the current
+// one.
+func NewURLSigner(keys []SigningKey) (*URLSigner, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no url signing key is configured, set signing_keys or URL_SIGNING_KEYS")
+	}
+
+	s := &URLSigner{current: keys[0].ID, keys: make(map[string][]byte)}
 
-	s := goalone.New(secretKey, goalone.Timestamp)
-	if strings.Contains(data, "?") {
-		urlToSign = fmt.Sprintf("%s&hash=", data)
-	} else {
-		urlToSign = fmt.Sprintf("%s?hash=", data)
+	var errs []error
+	for _, key := range keys {
+		switch {
+		case !signingKeyID.MatchString(key.ID):
+			errs = append(errs, fmt.Errorf("url signing key id %q may only have letters, digits, - and _", key.ID))
+		case s.keys[key.ID] != nil:
+			errs = append(errs, fmt.Errorf("url signing key id %q is used twice", key.ID))
+		case len(key.Secret) < minSigningKeyLength:
+			errs = append(errs, fmt.Errorf("url signing key %q must be at least %d characters", key.ID, minSigningKeyLength))
+		default:
+			s.keys[key.ID] = []byte(key.Secret)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
 	}
 
-	tokenBytes := s.Sign([]byte(urlToSign))
-	token := string(tokenBytes)
+	return s, nil
+}
+
+// Sign signs a url by adding a hash parameter. Only the path and query are
+// signed, so the link verifies whatever host and scheme it arrives through.
+func (s *URLSigner) Sign(data string) string {
+	u, err := url.Parse(data)
+	if err != nil {
+		return data
+	}
 
-	return token
+	payload := canonicalURL(u)
+	token := goalone.New(s.keys[s.current], goalone.Timestamp).Sign([]byte(payload))
+
+	u.RawQuery = ""
+	if _, query, ok := strings.Cut(payload, "?"); ok {
+		u.RawQuery = query + "&"
+	}
+	u.RawQuery += "hash=" + url.QueryEscape(s.current+"."+string(token[len(payload)+1:]))
+
+	return u.String()
 }
 
-func VerifyToken(token string) bool {
-	s := goalone.New(secretKey, goalone.Timestamp)
-	_, err := s.Unsign([]byte(token))
+// Verify checks the hash on a signed url, which may be just its path and
+// query, like a request's RequestURI.
+func (s *URLSigner) Verify(token string) bool {
+	sword, signed, ok := s.parse(token)
+	if !ok {
+		return false
+	}
+
+	_, err := sword.Unsign(signed)
 	return err == nil
 }
 
-func Expired(token string, minutesUntilExpire int) bool {
-	s := goalone.New(secretKey, goalone.Timestamp)
-	ts := s.Parse([]byte(token))
+// Expired reports whether a signed url is older than ttl.
+func (s *URLSigner) Expired(token string, ttl time.Duration) bool {
+	sword, signed, ok := s.parse(token)
+	if !ok {
+		return true
+	}
 
-	return time.Since(ts.Timestamp) > time.Duration(minutesUntilExpire)*time.Minute
+	return time.Since(sword.Parse(signed).Timestamp) > ttl
+}
+
+// parse puts a signed url back in the form goalone verifies, along with the
+// key it names.
+func (s *URLSigner) parse(token string) (*goalone.Sword, []byte, bool) {
+	u, err := url.Parse(token)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	id, hash, ok := strings.Cut(u.Query().Get("hash"), ".")
+	if !ok {
+		return nil, nil, false
+	}
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, nil, false
+	}
+
+	return goalone.New(key, goalone.Timestamp), []byte(canonicalURL(u) + "." + hash), true
+}
+
+// canonicalURL is what gets signed: the decoded path and the query without
+// its hash, sorted by key, so reordering or re-encoding the query on the way
+// does not break the signature.
+func canonicalURL(u *url.URL) string {
+	q := u.Query()
+	q.Del("hash")
+
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	if len(q) == 0 {
+		return path
+	}
+	return path + "?" + q.Encode()
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestURLSigner_Verify(t *testing.T) {
+	signed := testApp.Signer.Sign("https://example.com/activate?token=abc&email=me%2Bmail@here.com")
+	if !strings.HasPrefix(signed, "https://example.com/activate?email=me%2Bmail%40here.com&token=abc&hash=test.") {
+		t.Fatalf("expected a canonical query with the hash last, got %s", signed)
+	}
+	_, query, _ := strings.Cut(signed, "?")
+	params := strings.Split(query, "&")
+
+	tests := []struct {
+		name     string
+		url      string
+		expected bool
+	}{
+		{"signed", signed, true},
+		{"path and query only", strings.TrimPrefix(signed, "https://example.com"), true},
+		{"another host", strings.Replace(signed, "https://example.com", "http://proxy.internal:3000", 1), true},
+		{"reordered query", "/activate?" + params[1] + "&" + params[2] + "&" + strings.Replace(params[0], "%40", "@", 1), true},
+		{"changed query", strings.Replace(signed, "token=abc", "token=abd", 1), false},
+		{"changed path", strings.Replace(signed, "/activate", "/reset", 1), false},
+		{"unknown key", strings.Replace(signed, "hash=test.", "hash=other.", 1), false},
+		{"no hash", "https://example.com/activate?email=me%2Bmail%40here.com&token=abc", false},
+	}
+
+	for _, e := range tests {
+		if got := testApp.Signer.Verify(e.url); got != e.expected {
+			t.Errorf("%s: expected %t, got %t for %s", e.name, e.expected, got, e.url)
+		}
+	}
+
+	if testApp.Signer.Expired(signed, time.Hour) {
+		t.Error("expected a new link not to be expired")
+	}
+}
+
+func TestURLSigner_rotation(t *testing.T) {
+	oldKey := SigningKey{ID: "old", Secret: strings.Repeat("o", minSigningKeyLength)}
+	newKey := SigningKey{ID: "new", Secret: strings.Repeat("n", minSigningKeyLength)}
+
+	before, _ := NewURLSigner([]SigningKey{oldKey})
+	during, _ := NewURLSigner([]SigningKey{newKey, oldKey})
+	after, _ := NewURLSigner([]SigningKey{newKey})
+
+	oldLink := before.Sign("/activate?token=abc")
+	newLink := during.Sign("/activate?token=abc")
+
+	if !strings.Contains(newLink, "hash=new.") {
+		t.Errorf("expected new links to be signed with the current key, got %s", newLink)
+	}
+	if !during.Verify(oldLink) || !during.Verify(newLink) {
+		t.Error("expected both keys to verify during the rotation")
+	}
+	if after.Verify(oldLink) || !after.Verify(newLink) {
+		t.Error("expected only the new key to verify after the rotation")
+	}
+}
+
+func TestNewURLSigner_invalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     []SigningKey
+		expected string
+	}{
+		{"no keys", nil, "no url signing key"},
+		{"short secret", []SigningKey{{ID: "a", Secret: "short"}}, "at least 32 characters"},
+		{"bad id", []SigningKey{{ID: "a.b", Secret: strings.Repeat("s", 32)}}, "may only have"},
+		{"duplicate id", []SigningKey{{ID: "a", Secret: strings.Repeat("s", 32)}, {ID: "a", Secret: strings.Repeat("t", 32)}}, "used twice"},
+	}
+
+	for _, e := range tests {
+		if _, err := NewURLSigner(e.keys); err == nil || !strings.Contains(err.Error(), e.expected) {
+			t.Errorf("%s: expected an error containing %s, got %v", e.name, e.expected, err)
+		}
+	}
+}
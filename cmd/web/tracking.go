@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// trackingPixel is a transparent 1x1 GIF.
+var trackingPixel = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// tracks reports whether opens and clicks of msg are recorded. Both the
+// message and its template can opt out.
+func (m *Mail) tracks(msg Message) bool {
+	return m.Tracking && !msg.NoTracking && msg.ID != "" && m.Templates.Tracked(msg.Template)
+}
+
+// track sends every web link in body through the click endpoint and adds a
+// pixel that loads from the open endpoint, both for message id.
+func (m *Mail) track(id, body string) string {
+	var b strings.Builder
+	pixel := false
+
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		raw := string(z.Raw())
+
+		switch tt {
+		case html.StartTagToken:
+			if token := z.Token(); token.Data == "a" && m.trackLink(id, &token) {
+				raw = token.String()
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "body" && !pixel {
+				b.WriteString(m.pixel(id))
+				pixel = true
+			}
+		}
+		b.WriteString(raw)
+	}
+
+	if !pixel {
+		b.WriteString(m.pixel(id))
+	}
+	return b.String()
+}
+
+// trackLink points an http or https link at the click endpoint, which
+// redirects to where it went.
+func (m *Mail) trackLink(id string, token *html.Token) bool {
+	for i, a := range token.Attr {
+		if a.Key != "href" {
+			continue
+		}
+		u, err := url.Parse(strings.TrimSpace(a.Val))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return false
+		}
+		token.Attr[i].Val = m.Signer.Sign(fmt.Sprintf("%s/mail/click/%s?url=%s", m.BaseURL, url.PathEscape(id), url.QueryEscape(u.String())))
+		return true
+	}
+	return false
+}
+
+// pixel loads from the open endpoint. The address is signed, so opens cannot
+// be recorded for made up messages.
+func (m *Mail) pixel(id string) string {
+	src := m.Signer.Sign(fmt.Sprintf("%s/mail/open/%s", m.BaseURL, url.PathEscape(id)))
+	return fmt.Sprintf(`<img src="%s" width="1" height="1" alt="" style="border: 0;"/>`, html.EscapeString(src))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"simple-mailer-go/data"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestMail_track(t *testing.T) {
+	m := Mail{BaseURL: "http://localhost:3000", Signer: testApp.Signer}
+
+	body := m.track("abc", `<html><body><a href="https://example.com/plans?id=1&amp;x=2">Plans</a> <a href="mailto:me@here.com">Mail</a></body></html>`)
+
+	if !strings.Contains(body, `href="http://localhost:3000/mail/click/abc?url=https%3A%2F%2Fexample.com%2Fplans%3Fid%3D1%26x%3D2&amp;hash=`) {
+		t.Errorf("expected the web link to go through the click endpoint, got %s", body)
+	}
+	if !strings.Contains(body, `href="mailto:me@here.com"`) {
+		t.Error("expected the mailto link to be left alone")
+	}
+	if !strings.Contains(body, `<img src="http://localhost:3000/mail/open/abc?hash=test.`) || !strings.Contains(body, `style="border: 0;"/></body>`) {
+		t.Errorf("expected the pixel at the end of the body, got %s", body)
+	}
+}
+
+func TestMail_tracks(t *testing.T) {
+	templates, err := NewMailTemplates(layoutFS(fstest.MapFS{
+		"news.md.gohtml":      {Data: []byte("News")},
+		"quiet.md.gohtml":     {Data: []byte("---\ntracking: false\n---\nQuiet")},
+		"secret.html.gohtml":  {Data: []byte(`{{define "body"}}Secret{{end}}{{define "no-tracking"}}{{end}}`)},
+		"secret.plain.gohtml": {Data: []byte(`{{define "body"}}Secret{{end}}`)},
+	}), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Mail{Templates: templates, Tracking: true}
+
+	tests := []struct {
+		name     string
+		msg      Message
+		expected bool
+	}{
+		{"tracked", Message{ID: "1", Template: "news"}, true},
+		{"message opts out", Message{ID: "1", Template: "news", NoTracking: true}, false},
+		{"markdown template opts out", Message{ID: "1", Template: "quiet"}, false},
+		{"html template opts out", Message{ID: "1", Template: "secret"}, false},
+	}
+
+	for _, e := range tests {
+		if got := m.tracks(e.msg); got != e.expected {
+			t.Errorf("%s: expected %t, got %t", e.name, e.expected, got)
+		}
+	}
+
+	m.Tracking = false
+	if m.tracks(Message{ID: "1", Template: "news"}) {
+		t.Error("expected nothing to be tracked with tracking off")
+	}
+}
+
+// recordedEvents keeps the mail events it is given.
+type recordedEvents struct {
+	data.MailEventTest
+	events []data.MailEvent
+}
+
+func (e *recordedEvents) Insert(event data.MailEvent) (int, error) {
+	e.events = append(e.events, event)
+	return len(e.events), nil
+}
+
+func TestConfig_TrackOpen(t *testing.T) {
+	body := (&Mail{BaseURL: testApp.BaseURL, Signer: testApp.Signer}).track("abc", "")
+	start := strings.Index(body, testApp.BaseURL)
+	pixel := strings.TrimPrefix(strings.ReplaceAll(body[start:strings.Index(body[start:], `"`)+start], "&amp;", "&"), testApp.BaseURL)
+
+	tests := []struct {
+		name     string
+		url      string
+		recorded int
+	}{
+		{"signed", pixel, 1},
+		{"unsigned", "/mail/open/abc", 0},
+		{"made up id", strings.Replace(pixel, "/abc?", "/xyz?", 1), 0},
+	}
+
+	for _, e := range tests {
+		events := &recordedEvents{}
+		app := testApp
+		app.Models.MailEvent = events
+
+		w := httptest.NewRecorder()
+		r := withURLParam(httptest.NewRequest("GET", e.url, nil), "id", "abc")
+
+		app.TrackOpen(w, r)
+
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/gif" {
+			t.Errorf("%s: expected a gif, got %d %s", e.name, w.Code, w.Header().Get("Content-Type"))
+		}
+		if len(events.events) != e.recorded {
+			t.Errorf("%s: expected %d recorded opens, got %d", e.name, e.recorded, len(events.events))
+		}
+	}
+}
+
+func TestConfig_PreviewMail_tracking(t *testing.T) {
+	app := testApp
+	app.Mailer.Tracking = true
+
+	r := httptest.NewRequest("GET", "/admin/mail/preview/invoice", nil)
+	r = withURLParam(r.WithContext(getCtx(r)), "template", "invoice")
+
+	preview, err := app.previewMail(r, "invoice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(preview.HTML, "/mail/open/") {
+		t.Error("expected the preview not to have a tracking pixel")
+	}
+}
+
+func TestConfig_TrackClick(t *testing.T) {
+	signed := (&Mail{BaseURL: testApp.BaseURL, Signer: testApp.Signer}).track("abc", `<a href="https://example.com/plans">Plans</a>`)
+	start := strings.Index(signed, testApp.BaseURL)
+	link := strings.ReplaceAll(signed[start:strings.Index(signed[start:], `"`)+start], "&amp;", "&")
+
+	tests := []struct {
+		name     string
+		url      string
+		location string
+	}{
+		{"signed", strings.TrimPrefix(link, testApp.BaseURL), "https://example.com/plans"},
+		{"tampered", strings.Replace(strings.TrimPrefix(link, testApp.BaseURL), url.QueryEscape("example.com"), url.QueryEscape("evil.com"), 1), "/"},
+	}
+
+	for _, e := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", e.url, nil)
+		r = withURLParam(r.WithContext(getCtx(r)), "id", "abc")
+
+		testApp.TrackClick(w, r)
+
+		if got := w.Header().Get("Location"); got != e.location {
+			t.Errorf("%s: expected redirect to %s, got %s", e.name, e.location, got)
+		}
+	}
+}
+
+func withURLParam(r *http.Request, key, value string) *http.Request {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add(key, value)
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// Transport delivers a fully built email and returns the receiving side's
+// reply to it, if it gives one.
+type Transport interface {
+	Send(email *mail.Email) (string, error)
+}
+
+// SessionTransport is a Transport that can keep a connection open across
+// messages. Every mail worker opens its own session, so a connection is never
+// shared between goroutines.
+type SessionTransport interface {
+	Transport
+	NewSession() TransportSession
+}
+
+type TransportSession interface {
+	Transport
+	Close() error
+}
+
+// errRejected is returned when the relay refuses a recipient or the message
+// for good, with a 5xx reply. Sending the message again would get the same
+// answer.
+var errRejected = errors.New("rejected by relay")
+
+// smtpTimeout bounds connecting to the relay and sending each message.
+const smtpTimeout = 10 * time.Second
+
+// SMTPTransport sends mail through an SMTP relay.
+type SMTPTransport struct {
+	Host       string
+	Port       int
+	Username   string
+	Password   string
+	Encryption string
+	// MessagesPerConnection is how many messages a session sends before it
+	// reconnects. Zero means no limit.
+	MessagesPerConnection int
+}
+
+// Send delivers a single message over a new connection.
+func (t *SMTPTransport) Send(email *mail.Email) (string, error) {
+	c, err := t.connect()
+	if err != nil {
+		return "", err
+	}
+	reply, err := c.send(email)
+	if err != nil {
+		c.close()
+		return "", err
+	}
+
+	// the message is already accepted, so a failed QUIT does not matter
+	_ = c.quit()
+
+	return reply, nil
+}
+
+func (t *SMTPTransport) NewSession() TransportSession {
+	return &smtpSession{transport: t}
+}
+
+// connect opens a connection to the relay, encrypts it as configured and
+// logs in when there is a username.
+func (t *SMTPTransport) connect() (*smtpConn, error) {
+	addr := net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	tlsConfig := &tls.Config{ServerName: t.Host}
+
+	var conn net.Conn
+	var err error
+	if t.Encryption == "ssl" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &smtpConn{conn: conn}
+	_ = conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c.client, err = smtp.NewClient(conn, t.Host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if t.Encryption != "ssl" && t.Encryption != "none" {
+		if err = c.client.StartTLS(tlsConfig); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+
+	if t.Username != "" {
+		if err = c.client.Auth(smtp.PlainAuth("", t.Username, t.Password, t.Host)); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// smtpConn is an open connection to the relay.
+type smtpConn struct {
+	conn   net.Conn
+	client *smtp.Client
+}
+
+// send delivers email and returns the relay's reply to it, such as
+// "250 2.0.0 Ok: queued as 4F2A1".
+func (c *smtpConn) send(email *mail.Email) (string, error) {
+	raw := rawMessage(email)
+	if err := email.GetError(); err != nil {
+		return "", err
+	}
+
+	_ = c.conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	if err := c.client.Mail(email.GetFrom()); err != nil {
+		return "", err
+	}
+	for _, rcpt := range email.GetRecipients() {
+		if err := c.client.Rcpt(rcpt); err != nil {
+			return "", rejected(err)
+		}
+	}
+
+	// smtp.Client.Data throws the relay's reply to the message away, so the
+	// DATA command is run by hand
+	id, err := c.client.Text.Cmd("DATA")
+	if err != nil {
+		return "", err
+	}
+	c.client.Text.StartResponse(id)
+	_, _, err = c.client.Text.ReadResponse(354)
+	c.client.Text.EndResponse(id)
+	if err != nil {
+		return "", rejected(err)
+	}
+
+	w := c.client.Text.DotWriter()
+	if _, err = io.WriteString(w, raw); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+
+	code, reply, err := c.client.Text.ReadResponse(250)
+	if err != nil {
+		return "", rejected(err)
+	}
+
+	return fmt.Sprintf("%d %s", code, strings.ReplaceAll(reply, "\n", " ")), nil
+}
+
+// quit ends the connection politely.
+func (c *smtpConn) quit() error {
+	err := c.client.Quit()
+	c.close()
+	return err
+}
+
+func (c *smtpConn) close() {
+	_ = c.client.Close()
+}
+
+// rejected marks err as errRejected when it is a permanent, 5xx reply, and
+// keeps the reply readable for the mail log.
+func rejected(err error) error {
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return fmt.Errorf("%w: %d %s", errRejected, reply.Code, strings.ReplaceAll(reply.Msg, "\n", " "))
+	}
+	return err
+}
+
+// smtpSession reuses one SMTP connection for consecutive messages.
+type smtpSession struct {
+	transport *SMTPTransport
+	conn      *smtpConn
+	sent      int
+}
+
+func (s *smtpSession) Send(email *mail.Email) (string, error) {
+	// the relay may have dropped an idle connection
+	if s.conn != nil {
+		_ = s.conn.conn.SetDeadline(time.Now().Add(smtpTimeout))
+		if s.conn.client.Noop() != nil {
+			s.conn.close()
+			s.conn = nil
+		}
+	}
+
+	if s.conn == nil {
+		conn, err := s.transport.connect()
+		if err != nil {
+			return "", err
+		}
+		s.conn = conn
+		s.sent = 0
+	}
+
+	reply, err := s.conn.send(email)
+	if err != nil {
+		s.conn.close()
+		s.conn = nil
+		return "", err
+	}
+
+	s.sent++
+	if s.transport.MessagesPerConnection > 0 && s.sent >= s.transport.MessagesPerConnection {
+		// the message is already accepted, so a failed QUIT does not matter
+		_ = s.Close()
+	}
+
+	return reply, nil
+}
+
+func (s *smtpSession) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.quit()
+	s.conn = nil
+	return err
+}
+
+// rawMessage returns the message as it goes over the wire, including the DKIM
+// signature when the email was signed.
+func rawMessage(email *mail.Email) string {
+	if email.DkimMsg != "" {
+		return email.DkimMsg
+	}
+	return email.GetMessage()
+}
+
+// FileTransport writes every message as an .eml file to Dir instead of
+// sending it, which is handy for local development without a mail server.
+type FileTransport struct {
+	Dir string
+}
+
+// Send returns the path of the file it wrote.
+func (t *FileTransport) Send(email *mail.Email) (string, error) {
+	raw := rawMessage(email)
+	if err := email.GetError(); err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(t.Dir, 0755); err != nil {
+		return "", err
+	}
+
+	// write to a temporary file first, so readers never see half a message
+	tmp, err := os.CreateTemp(t.Dir, ".mail-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.WriteString(raw); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+
+	name := filepath.Join(t.Dir, fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), filepath.Base(tmp.Name())[len(".mail-"):]))
+	if err = os.Rename(tmp.Name(), name); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// SentMail is a message captured by MemoryTransport.
+type SentMail struct {
+	From       string
+	Recipients []string
+	Raw        string
+}
+
+// MemoryTransport keeps every message it is given, so tests can inspect
+// exactly what would have been sent.
+type MemoryTransport struct {
+	mu   sync.Mutex
+	sent []SentMail
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{}
+}
+
+func (t *MemoryTransport) Send(email *mail.Email) (string, error) {
+	raw := rawMessage(email)
+	if err := email.GetError(); err != nil {
+		return "", err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sent = append(t.sent, SentMail{
+		From:       email.GetFrom(),
+		Recipients: email.GetRecipients(),
+		Raw:        raw,
+	})
+
+	return "", nil
+}
+
+func (t *MemoryTransport) Sent() []SentMail {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sent := make([]SentMail, len(t.sent))
+	copy(sent, t.sent)
+	return sent
+}
+
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sent = nil
+}
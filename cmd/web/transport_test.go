@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+func TestFileTransport_Send(t *testing.T) {
+	dir := t.TempDir()
+	transport := &FileTransport{Dir: dir}
+
+	email := mail.NewMSG()
+	email.SetFrom("info@localhost").AddTo("me@here.com").SetSubject("Dropped")
+	email.SetBody(mail.TextPlain, "hello")
+
+	path, err := transport.Send(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 .eml file, got %d", len(files))
+	}
+	if path != files[0] {
+		t.Errorf("expected Send to return the file it wrote, got %s", path)
+	}
+
+	content, _ := os.ReadFile(files[0])
+	if !strings.Contains(string(content), "Subject: Dropped") {
+		t.Error("expected dropped file to contain the message")
+	}
+}
+
+// fakeSMTPServer accepts SMTP connections and counts how many were opened and
+// how many messages were delivered. It refuses the recipients in unknown.
+type fakeSMTPServer struct {
+	listener    net.Listener
+	unknown     []string
+	connections int32
+	messages    int32
+}
+
+func newFakeSMTPServer(t *testing.T, unknown ...string) *fakeSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{listener: l, unknown: unknown}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.connections, 1)
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeSMTPServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 localhost ready\r\n")
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			fmt.Fprint(conn, "250-localhost\r\n250 8BITMIME\r\n")
+		case strings.HasPrefix(cmd, "RCPT") && s.refuses(cmd):
+			fmt.Fprint(conn, "550 5.1.1 no such user\r\n")
+		case strings.HasPrefix(cmd, "DATA"):
+			fmt.Fprint(conn, "354 go ahead\r\n")
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+			}
+			atomic.AddInt32(&s.messages, 1)
+			fmt.Fprint(conn, "250 2.0.0 Ok: queued as 4F2A1\r\n")
+		case strings.HasPrefix(cmd, "QUIT"):
+			fmt.Fprint(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 ok\r\n")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) refuses(cmd string) bool {
+	for _, addr := range s.unknown {
+		if strings.Contains(cmd, strings.ToUpper("<"+addr+">")) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSMTPTransport_Send(t *testing.T) {
+	server := newFakeSMTPServer(t, "gone@here.com")
+	transport := &SMTPTransport{Host: "127.0.0.1", Port: server.port(), Encryption: "none"}
+
+	email := mail.NewMSG()
+	email.SetFrom("info@localhost").AddTo("me@here.com").SetSubject("Hello")
+	email.SetBody(mail.TextPlain, "hello")
+
+	reply, err := transport.Send(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "250 2.0.0 Ok: queued as 4F2A1" {
+		t.Errorf("expected the relay's reply, got %q", reply)
+	}
+
+	email = mail.NewMSG()
+	email.SetFrom("info@localhost").AddTo("gone@here.com").SetSubject("Hello")
+	email.SetBody(mail.TextPlain, "hello")
+
+	_, err = transport.Send(email)
+	if !errors.Is(err, errRejected) {
+		t.Errorf("expected the unknown recipient to be rejected, got %v", err)
+	}
+	if n := atomic.LoadInt32(&server.messages); n != 1 {
+		t.Errorf("expected only the first message to be delivered, got %d", n)
+	}
+}
+
+func TestSMTPTransport_NewSession(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	transport := &SMTPTransport{
+		Host:                  "127.0.0.1",
+		Port:                  server.port(),
+		Encryption:            "none",
+		MessagesPerConnection: 2,
+	}
+
+	session := transport.NewSession()
+	for i := 0; i < 3; i++ {
+		email := mail.NewMSG()
+		email.SetFrom("info@localhost").AddTo("me@here.com").SetSubject("Session")
+		email.SetBody(mail.TextPlain, "hello")
+
+		if _, err := session.Send(email); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = session.Close()
+
+	if n := atomic.LoadInt32(&server.messages); n != 3 {
+		t.Errorf("expected 3 delivered messages, got %d", n)
+	}
+	if n := atomic.LoadInt32(&server.connections); n != 2 {
+		t.Errorf("expected 2 connections for 3 messages at 2 per connection, got %d", n)
+	}
+}
@@ -0,0 +1,112 @@
+package data
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// DeadLetter is a message that could not be delivered after all retries. The
+// payload is kept as queued, so it can be replayed later.
+type DeadLetter struct {
+	ID        int
+	Payload   []byte
+	LastError string
+	Attempts  int
+	CreatedAt time.Time
+}
+
+func (d *DeadLetter) GetAll() ([]*DeadLetter, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, payload, last_error, attempts, created_at
+	from mail_dead_letters order by id desc`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var letters []*DeadLetter
+
+	for rows.Next() {
+		var letter DeadLetter
+		err := rows.Scan(
+			&letter.ID,
+			&letter.Payload,
+			&letter.LastError,
+			&letter.Attempts,
+			&letter.CreatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		letters = append(letters, &letter)
+	}
+
+	return letters, nil
+}
+
+func (d *DeadLetter) GetOne(id int) (*DeadLetter, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, payload, last_error, attempts, created_at from mail_dead_letters where id = $1`
+
+	var letter DeadLetter
+	row := db.QueryRowContext(ctx, query, id)
+
+	err := row.Scan(
+		&letter.ID,
+		&letter.Payload,
+		&letter.LastError,
+		&letter.Attempts,
+		&letter.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &letter, nil
+}
+
+func (d *DeadLetter) Insert(payload []byte, lastError string, attempts int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into mail_dead_letters (payload, last_error, attempts, created_at)
+		values ($1, $2, $3, $4) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		payload,
+		lastError,
+		attempts,
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+func (d *DeadLetter) DeleteByID(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from mail_dead_letters where id = $1`
+
+	_, err := db.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
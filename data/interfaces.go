@@ -1,5 +1,7 @@
 package data
 
+import "time"
+
 type UserInterface interface {
 	GetAll() ([]*User, error)
 	GetByEmail(email string) (*User, error)
@@ -8,6 +10,7 @@ type UserInterface interface {
 	Delete() error
 	DeleteByID(id int) error
 	Insert(user User) (int, error)
+	ResetPassword(id int, password string) error
 	PasswordMatches(password string) (bool, error)
 }
 type PlanInterface interface {
@@ -16,3 +19,37 @@ type PlanInterface interface {
 	SubscribeUserToPlan(user User, plan Plan) error
 	AmountForDisplay() string
 }
+
+type MailQueueInterface interface {
+	GetAll() ([]*QueuedMail, error)
+	Insert(payload []byte, availableAt time.Time) (int, error)
+	Claim(limit int, lease time.Duration) ([]*QueuedMail, error)
+	Retry(id, attempts int, lastError string, availableAt time.Time) error
+	Unclaim(ids []int) error
+	DeleteByID(id int) error
+}
+
+type DeadLetterInterface interface {
+	GetAll() ([]*DeadLetter, error)
+	GetOne(id int) (*DeadLetter, error)
+	Insert(payload []byte, lastError string, attempts int) (int, error)
+	DeleteByID(id int) error
+}
+
+type MailLogInterface interface {
+	Insert(entry MailLog) error
+	UpdateStatus(id, status, response string) error
+	GetOne(id string) (*MailLog, error)
+	GetByUser(userID int) ([]*MailLog, error)
+}
+
+type TokenInterface interface {
+	Issue(userID int, purpose string, ttl time.Duration) (string, error)
+	Consume(plain, purpose string) (*Token, error)
+	Revoke(userID int, purpose string) error
+}
+
+type MailEventInterface interface {
+	Insert(event MailEvent) (int, error)
+	GetByMessage(messageID string) ([]*MailEvent, error)
+}
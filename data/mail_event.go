@@ -0,0 +1,82 @@
+package data
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	MailEventOpen  = "open"
+	MailEventClick = "click"
+)
+
+// MailEvent records a recipient opening a message or clicking a link in it.
+type MailEvent struct {
+	ID        int
+	MessageID string
+	Event     string
+	URL       string
+	UserAgent string
+	CreatedAt time.Time
+}
+
+func (e *MailEvent) Insert(event MailEvent) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into mail_events (message_id, event, url, user_agent, created_at)
+		values ($1, $2, $3, $4, $5) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		event.MessageID,
+		event.Event,
+		event.URL,
+		event.UserAgent,
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetByMessage returns the events for a message, oldest first.
+func (e *MailEvent) GetByMessage(messageID string) ([]*MailEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, message_id, event, url, user_agent, created_at
+	from mail_events where message_id = $1 order by created_at`
+
+	rows, err := db.QueryContext(ctx, query, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*MailEvent
+
+	for rows.Next() {
+		var event MailEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.MessageID,
+			&event.Event,
+			&event.URL,
+			&event.UserAgent,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		events = append(events, &event)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,161 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+const (
+	MailStatusQueued     = "queued"
+	MailStatusSending    = "sending"
+	MailStatusSent       = "sent"
+	MailStatusFailed     = "failed"
+	MailStatusBounced    = "bounced"
+	MailStatusSuppressed = "suppressed"
+)
+
+// MailLog records what happened to one outgoing message. A message is
+// bounced when the relay refuses it for good while it is being sent.
+type MailLog struct {
+	ID         string
+	UserID     int
+	Recipients string
+	Subject    string
+	Template   string
+	Status     string
+	Response   string
+	Attempts   int
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	SentAt     *time.Time
+}
+
+func (m *MailLog) Insert(entry MailLog) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into mail_log (id, user_id, recipients, subject, template, status, response, attempts, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+
+	var userID sql.NullInt64
+	if entry.UserID != 0 {
+		userID = sql.NullInt64{Int64: int64(entry.UserID), Valid: true}
+	}
+
+	_, err := db.ExecContext(ctx, stmt,
+		entry.ID,
+		userID,
+		entry.Recipients,
+		entry.Subject,
+		entry.Template,
+		MailStatusQueued,
+		"",
+		0,
+		time.Now(),
+		time.Now(),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateStatus moves a message to status. response is the relay's answer,
+// if there was one. Moving to sending counts as a delivery attempt.
+func (m *MailLog) UpdateStatus(id, status, response string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update mail_log set
+		status = $1,
+		response = $2,
+		attempts = attempts + case when $1 = 'sending' then 1 else 0 end,
+		sent_at = case when $1 = 'sent' then $3 else sent_at end,
+		updated_at = $3
+		where id = $4`
+
+	_, err := db.ExecContext(ctx, stmt, status, response, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *MailLog) GetOne(id string) (*MailLog, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, coalesce(user_id, 0), recipients, subject, template, status, response, attempts, created_at, updated_at, sent_at
+	from mail_log where id = $1`
+
+	rows, err := db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries, err := scanMailLog(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return entries[0], nil
+}
+
+// GetByUser returns the messages sent to a user, newest first.
+func (m *MailLog) GetByUser(userID int) ([]*MailLog, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, coalesce(user_id, 0), recipients, subject, template, status, response, attempts, created_at, updated_at, sent_at
+	from mail_log where user_id = $1 order by created_at desc`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMailLog(rows)
+}
+
+func scanMailLog(rows *sql.Rows) ([]*MailLog, error) {
+	var entries []*MailLog
+
+	for rows.Next() {
+		var entry MailLog
+		var sentAt sql.NullTime
+		err := rows.Scan(
+			&entry.ID,
+			&entry.UserID,
+			&entry.Recipients,
+			&entry.Subject,
+			&entry.Template,
+			&entry.Status,
+			&entry.Response,
+			&entry.Attempts,
+			&entry.CreatedAt,
+			&entry.UpdatedAt,
+			&sentAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		if sentAt.Valid {
+			entry.SentAt = &sentAt.Time
+		}
+		entries = append(entries, &entry)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,192 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+const (
+	MailQueued  = "queued"
+	MailSending = "sending"
+)
+
+type QueuedMail struct {
+	ID          int
+	Payload     []byte
+	Status      string
+	Attempts    int
+	LastError   string
+	AvailableAt time.Time
+	// LockedUntil is when the lease of the instance sending the message runs
+	// out.
+	LockedUntil *time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Insert queues a message. It is not claimed before availableAt, which is how
+// scheduled messages wait until they are due.
+func (q *QueuedMail) Insert(payload []byte, availableAt time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into mail_queue (payload, status, attempts, last_error, available_at, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		payload,
+		MailQueued,
+		0,
+		"",
+		availableAt,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+func (q *QueuedMail) GetAll() ([]*QueuedMail, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, payload, status, attempts, last_error, available_at, locked_until, created_at, updated_at
+	from mail_queue order by id`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanQueuedMail(rows)
+}
+
+// Claim marks up to limit queued messages that are due as sending and returns
+// them, leased to the caller for lease. Rows locked by another instance are
+// skipped, so several processes can drain the same table. A message whose
+// lease ran out, e.g. because its instance crashed, is claimed again.
+func (q *QueuedMail) Claim(limit int, lease time.Duration) ([]*QueuedMail, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `update mail_queue set status = $1, locked_until = $2, updated_at = $3
+	where id in (
+		select id from mail_queue
+		where (status = $4 and available_at <= $3) or (status = $1 and locked_until <= $3)
+		order by available_at, id
+		limit $5
+		for update skip locked
+	)
+	returning id, payload, status, attempts, last_error, available_at, locked_until, created_at, updated_at`
+
+	now := time.Now()
+	rows, err := db.QueryContext(ctx, query, MailSending, now.Add(lease), now, MailQueued, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanQueuedMail(rows)
+}
+
+// Unclaim hands messages this instance claimed but did not send back to the
+// queue, so they can be claimed again straight away instead of after their
+// lease runs out.
+func (q *QueuedMail) Unclaim(ids []int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update mail_queue set status = $1, locked_until = null, updated_at = $2
+	where id = any($3) and status = $4`
+
+	_, err := db.ExecContext(ctx, stmt, MailQueued, time.Now(), ids, MailSending)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Retry puts a message back in the queue after a failed attempt. It will not
+// be claimed again before availableAt.
+func (q *QueuedMail) Retry(id, attempts int, lastError string, availableAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update mail_queue set
+		status = $1,
+		attempts = $2,
+		last_error = $3,
+		available_at = $4,
+		locked_until = null,
+		updated_at = $5
+		where id = $6`
+
+	_, err := db.ExecContext(ctx, stmt,
+		MailQueued,
+		attempts,
+		lastError,
+		availableAt,
+		time.Now(),
+		id,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (q *QueuedMail) DeleteByID(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from mail_queue where id = $1`
+
+	_, err := db.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func scanQueuedMail(rows *sql.Rows) ([]*QueuedMail, error) {
+	var queued []*QueuedMail
+
+	for rows.Next() {
+		var q QueuedMail
+		var lockedUntil sql.NullTime
+		err := rows.Scan(
+			&q.ID,
+			&q.Payload,
+			&q.Status,
+			&q.Attempts,
+			&q.LastError,
+			&q.AvailableAt,
+			&lockedUntil,
+			&q.CreatedAt,
+			&q.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		if lockedUntil.Valid {
+			q.LockedUntil = &lockedUntil.Time
+		}
+
+		queued = append(queued, &q)
+	}
+
+	return queued, nil
+}
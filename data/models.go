@@ -13,12 +13,22 @@ func New(dbPool *sql.DB) Models {
 	db = dbPool
 
 	return Models{
-		User: &User{},
-		Plan: &Plan{},
+		User:       &User{},
+		Plan:       &Plan{},
+		MailQueue:  &QueuedMail{},
+		DeadLetter: &DeadLetter{},
+		MailLog:    &MailLog{},
+		MailEvent:  &MailEvent{},
+		Token:      &Token{},
 	}
 }
 
 type Models struct {
-	User UserInterface
-	Plan PlanInterface
+	User       UserInterface
+	Plan       PlanInterface
+	MailQueue  MailQueueInterface
+	DeadLetter DeadLetterInterface
+	MailLog    MailLogInterface
+	MailEvent  MailEventInterface
+	Token      TokenInterface
 }
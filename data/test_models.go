@@ -9,8 +9,13 @@ import (
 func TestNew(dbPool *sql.DB) Models {
 	db = dbPool
 	return Models{
-		User: &UserTest{},
-		Plan: &PlanTest{},
+		User:       &UserTest{},
+		Plan:       &PlanTest{},
+		MailQueue:  &QueuedMailTest{},
+		DeadLetter: &DeadLetterTest{},
+		MailLog:    &MailLogTest{},
+		MailEvent:  &MailEventTest{},
+		Token:      &TokenTest{},
 	}
 }
 
@@ -22,6 +27,7 @@ type UserTest struct {
 	Password  string
 	Active    int
 	IsAdmin   int
+	Language  string
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	Plan      *Plan
@@ -37,6 +43,7 @@ func (u *UserTest) GetAll() ([]*User, error) {
 			Password:  "password",
 			Active:    1,
 			IsAdmin:   1,
+			Language:  "en",
 			CreatedAt: time.Now(),
 			UpdatedAt: time.Now(),
 		},
@@ -52,6 +59,7 @@ func (u *UserTest) GetByEmail(email string) (*User, error) {
 		Password:  "password",
 		Active:    1,
 		IsAdmin:   1,
+		Language:  "en",
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}, nil
@@ -66,6 +74,7 @@ func (u *UserTest) GetOne(id int) (*User, error) {
 		Password:  "password",
 		Active:    1,
 		IsAdmin:   1,
+		Language:  "en",
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}, nil
@@ -83,7 +92,7 @@ func (u *UserTest) Insert(user User) (int, error) {
 	return 2, nil
 }
 
-func (u *UserTest) ResetPassword(password string) error {
+func (u *UserTest) ResetPassword(id int, password string) error {
 	return nil
 }
 func (u *UserTest) Update(user User) error {
@@ -135,3 +144,189 @@ func (p *PlanTest) AmountForDisplay() string {
 	amount := float64(p.PlanAmount) / 100.0
 	return fmt.Sprintf("$%.2f", amount)
 }
+
+type QueuedMailTest struct {
+	ID          int
+	Payload     []byte
+	Status      string
+	Attempts    int
+	LastError   string
+	AvailableAt time.Time
+	LockedUntil *time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (q *QueuedMailTest) GetAll() ([]*QueuedMail, error) {
+	return []*QueuedMail{}, nil
+}
+
+func (q *QueuedMailTest) Insert(payload []byte, availableAt time.Time) (int, error) {
+	return 1, nil
+}
+
+func (q *QueuedMailTest) Claim(limit int, lease time.Duration) ([]*QueuedMail, error) {
+	return []*QueuedMail{}, nil
+}
+
+func (q *QueuedMailTest) Retry(id, attempts int, lastError string, availableAt time.Time) error {
+	return nil
+}
+
+func (q *QueuedMailTest) Unclaim(ids []int) error {
+	return nil
+}
+
+func (q *QueuedMailTest) DeleteByID(id int) error {
+	return nil
+}
+
+type DeadLetterTest struct {
+	ID        int
+	Payload   []byte
+	LastError string
+	Attempts  int
+	CreatedAt time.Time
+}
+
+func (d *DeadLetterTest) GetAll() ([]*DeadLetter, error) {
+	return []*DeadLetter{
+		{
+			ID:        1,
+			Payload:   []byte(`{"To":"admin@test.com","Subject":"Your invoice plan","Data":"$10.00","Template":"invoice"}`),
+			LastError: "dial tcp: connection refused",
+			Attempts:  5,
+			CreatedAt: time.Now(),
+		},
+	}, nil
+}
+
+func (d *DeadLetterTest) GetOne(id int) (*DeadLetter, error) {
+	return &DeadLetter{
+		ID:        1,
+		Payload:   []byte(`{"To":"admin@test.com","Subject":"Your invoice plan","Data":"$10.00","Template":"invoice"}`),
+		LastError: "dial tcp: connection refused",
+		Attempts:  5,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+func (d *DeadLetterTest) Insert(payload []byte, lastError string, attempts int) (int, error) {
+	return 1, nil
+}
+
+func (d *DeadLetterTest) DeleteByID(id int) error {
+	return nil
+}
+
+type MailLogTest struct {
+	ID         string
+	UserID     int
+	Recipients string
+	Subject    string
+	Template   string
+	Status     string
+	Response   string
+	Attempts   int
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	SentAt     *time.Time
+}
+
+func (m *MailLogTest) Insert(entry MailLog) error {
+	return nil
+}
+
+func (m *MailLogTest) UpdateStatus(id, status, response string) error {
+	return nil
+}
+
+func (m *MailLogTest) GetOne(id string) (*MailLog, error) {
+	return &MailLog{
+		ID:         id,
+		UserID:     1,
+		Recipients: "admin@test.com",
+		Subject:    "Your invoice plan",
+		Template:   "invoice",
+		Status:     MailStatusSent,
+		Attempts:   1,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+	}, nil
+}
+
+func (m *MailLogTest) GetByUser(userID int) ([]*MailLog, error) {
+	return []*MailLog{
+		{
+			ID:         "1",
+			UserID:     userID,
+			Recipients: "admin@test.com",
+			Subject:    "Your invoice plan",
+			Template:   "invoice",
+			Status:     MailStatusSent,
+			Attempts:   1,
+			CreatedAt:  time.Now(),
+			UpdatedAt:  time.Now(),
+		},
+	}, nil
+}
+
+type MailEventTest struct {
+	ID        int
+	MessageID string
+	Event     string
+	URL       string
+	UserAgent string
+	CreatedAt time.Time
+}
+
+func (e *MailEventTest) Insert(event MailEvent) (int, error) {
+	return 1, nil
+}
+
+func (e *MailEventTest) GetByMessage(messageID string) ([]*MailEvent, error) {
+	return []*MailEvent{
+		{
+			ID:        1,
+			MessageID: messageID,
+			Event:     MailEventOpen,
+			UserAgent: "Mozilla/5.0",
+			CreatedAt: time.Now(),
+		},
+	}, nil
+}
+
+type TokenTest struct {
+	ID        int
+	UserID    int
+	Purpose   string
+	Hash      string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+func (t *TokenTest) Issue(userID int, purpose string, ttl time.Duration) (string, error) {
+	return "test-token", nil
+}
+
+// Consume accepts only the token Issue hands out.
+func (t *TokenTest) Consume(plain, purpose string) (*Token, error) {
+	if plain != "test-token" {
+		return nil, ErrTokenInvalid
+	}
+	now := time.Now()
+	return &Token{
+		ID:        1,
+		UserID:    1,
+		Purpose:   purpose,
+		ExpiresAt: now.Add(time.Hour),
+		UsedAt:    &now,
+		CreatedAt: now,
+	}, nil
+}
+
+func (t *TokenTest) Revoke(userID int, purpose string) error {
+	return nil
+}
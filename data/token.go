@@ -0,0 +1,137 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const (
+	TokenActivation    = "activation"
+	TokenPasswordReset = "password_reset"
+	TokenEmailChange   = "email_change"
+)
+
+// ErrTokenInvalid is returned when consuming a token that does not exist,
+// was issued for another purpose, or is used, revoked or expired.
+var ErrTokenInvalid = errors.New("token is invalid or expired")
+
+// Token lets a user do one thing once, like activating their account. Only
+// a hash of the token is stored; the plain text is sent to the user.
+type Token struct {
+	ID        int
+	UserID    int
+	Purpose   string
+	Hash      string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+// Issue creates a token for userID and purpose that is valid for ttl and
+// returns its plain text. Any unused token the user has for the same purpose
+// is revoked, so only the newest one works.
+func (t *Token) Issue(userID int, purpose string, ttl time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	plain := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	stmt := `update tokens set revoked_at = $1
+		where user_id = $2 and purpose = $3 and used_at is null and revoked_at is null`
+
+	if _, err := tx.ExecContext(ctx, stmt, now, userID, purpose); err != nil {
+		return "", err
+	}
+
+	stmt = `insert into tokens (user_id, purpose, token_hash, expires_at, created_at)
+		values ($1, $2, $3, $4, $5)`
+
+	if _, err := tx.ExecContext(ctx, stmt, userID, purpose, hashToken(plain), now.Add(ttl), now); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return plain, nil
+}
+
+// Consume marks the token used and returns it. It fails with
+// ErrTokenInvalid unless the token was issued for purpose and is still
+// unused, unrevoked and unexpired, so of two concurrent calls only one wins.
+func (t *Token) Consume(plain, purpose string) (*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `update tokens set used_at = $1
+		where token_hash = $2 and purpose = $3 and used_at is null and revoked_at is null and expires_at > $1
+		returning id, user_id, purpose, token_hash, expires_at, used_at, revoked_at, created_at`
+
+	var token Token
+	var usedAt, revokedAt sql.NullTime
+	err := db.QueryRowContext(ctx, query, time.Now(), hashToken(plain), purpose).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Purpose,
+		&token.Hash,
+		&token.ExpiresAt,
+		&usedAt,
+		&revokedAt,
+		&token.CreatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if usedAt.Valid {
+		token.UsedAt = &usedAt.Time
+	}
+	if revokedAt.Valid {
+		token.RevokedAt = &revokedAt.Time
+	}
+
+	return &token, nil
+}
+
+// Revoke revokes every unused token the user has for purpose.
+func (t *Token) Revoke(userID int, purpose string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update tokens set revoked_at = $1
+		where user_id = $2 and purpose = $3 and used_at is null and revoked_at is null`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), userID, purpose)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func hashToken(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
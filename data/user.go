@@ -17,6 +17,7 @@ type User struct {
 	Password  string
 	Active    int
 	IsAdmin   int
+	Language  string
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	Plan      *Plan
@@ -35,6 +36,7 @@ func (u *User) GetAll() ([]*User, error) {
        	password, 
        	user_active, 
        	is_admin, 
+       	language, 
        	created_at, 
        	updated_at
 	from 
@@ -60,6 +62,7 @@ func (u *User) GetAll() ([]*User, error) {
 			&user.Password,
 			&user.Active,
 			&user.IsAdmin,
+			&user.Language,
 			&user.CreatedAt,
 			&user.UpdatedAt,
 		)
@@ -87,6 +90,7 @@ func (u *User) GetByEmail(email string) (*User, error) {
 			    password, 
 			    user_active, 
 			    is_admin, 
+			    language, 
 			    created_at, 
 			    updated_at 
 			from 
@@ -105,6 +109,7 @@ func (u *User) GetByEmail(email string) (*User, error) {
 		&user.Password,
 		&user.Active,
 		&user.IsAdmin,
+		&user.Language,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -140,7 +145,7 @@ func (u *User) GetOne(id int) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, is_admin, created_at, updated_at 
+	query := `select id, email, first_name, last_name, password, user_active, is_admin, language, created_at, updated_at 
 				from users 
 				where id = $1`
 
@@ -155,6 +160,7 @@ func (u *User) GetOne(id int) (*User, error) {
 		&user.Password,
 		&user.Active,
 		&user.IsAdmin,
+		&user.Language,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -197,14 +203,16 @@ func (u *User) Update(user User) error {
 		first_name = $2,
 		last_name = $3,
 		user_active = $4,
-		updated_at = $5
-		where id = $6`
+		language = $5,
+		updated_at = $6
+		where id = $7`
 
 	_, err := db.ExecContext(ctx, stmt,
 		user.Email,
 		user.FirstName,
 		user.LastName,
 		user.Active,
+		user.Language,
 		time.Now(),
 		user.ID,
 	)
@@ -254,8 +262,8 @@ func (u *User) Insert(user User) (int, error) {
 	}
 
 	var newID int
-	stmt := `insert into users (email, first_name, last_name, password, user_active, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+	stmt := `insert into users (email, first_name, last_name, password, user_active, language, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
 
 	err = db.QueryRowContext(ctx, stmt,
 		user.Email,
@@ -263,6 +271,7 @@ func (u *User) Insert(user User) (int, error) {
 		user.LastName,
 		hashedPassword,
 		user.Active,
+		user.Language,
 		time.Now(),
 		time.Now(),
 	).Scan(&newID)
@@ -274,7 +283,7 @@ func (u *User) Insert(user User) (int, error) {
 	return newID, nil
 }
 
-func (u *User) ResetPassword(password string) error {
+func (u *User) ResetPassword(id int, password string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
@@ -284,7 +293,7 @@ func (u *User) ResetPassword(password string) error {
 	}
 
 	stmt := `update users set password = $1 where id = $2`
-	_, err = db.ExecContext(ctx, stmt, hashedPassword, u.ID)
+	_, err = db.ExecContext(ctx, stmt, hashedPassword, id)
 	if err != nil {
 		return err
 	}
@@ -72,11 +72,147 @@ CREATE TABLE public.users (
                               password character varying(60),
                               user_active integer DEFAULT 0,
                               is_admin integer default 0,
+                              language character varying(10) DEFAULT 'en'::character varying NOT NULL,
                               created_at timestamp without time zone,
                               updated_at timestamp without time zone
 );
 
 
+--
+-- Name: mail_queue; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.mail_queue (
+                                   id integer NOT NULL,
+                                   payload jsonb NOT NULL,
+                                   status character varying(20) DEFAULT 'queued' NOT NULL,
+                                   attempts integer DEFAULT 0 NOT NULL,
+                                   last_error text DEFAULT '' NOT NULL,
+                                   available_at timestamp without time zone DEFAULT now() NOT NULL,
+                                   locked_until timestamp without time zone,
+                                   created_at timestamp without time zone,
+                                   updated_at timestamp without time zone
+);
+
+
+--
+-- Name: mail_queue_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.mail_queue ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.mail_queue_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: mail_dead_letters; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.mail_dead_letters (
+                                          id integer NOT NULL,
+                                          payload jsonb NOT NULL,
+                                          last_error text DEFAULT '' NOT NULL,
+                                          attempts integer DEFAULT 0 NOT NULL,
+                                          created_at timestamp without time zone
+);
+
+
+--
+-- Name: mail_dead_letters_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.mail_dead_letters ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.mail_dead_letters_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: mail_log; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.mail_log (
+                                 id character varying(32) NOT NULL,
+                                 user_id integer,
+                                 recipients text DEFAULT '' NOT NULL,
+                                 subject character varying(255),
+                                 template character varying(255),
+                                 status character varying(20) DEFAULT 'queued' NOT NULL,
+                                 response text DEFAULT '' NOT NULL,
+                                 attempts integer DEFAULT 0 NOT NULL,
+                                 created_at timestamp without time zone,
+                                 updated_at timestamp without time zone,
+                                 sent_at timestamp without time zone
+);
+
+
+--
+-- Name: tokens; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.tokens (
+                               id integer NOT NULL,
+                               user_id integer NOT NULL,
+                               purpose character varying(32) NOT NULL,
+                               token_hash character(64) NOT NULL,
+                               expires_at timestamp without time zone NOT NULL,
+                               used_at timestamp without time zone,
+                               revoked_at timestamp without time zone,
+                               created_at timestamp without time zone
+);
+
+
+--
+-- Name: tokens_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.tokens ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.tokens_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: mail_events; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.mail_events (
+                                    id integer NOT NULL,
+                                    message_id character varying(32) NOT NULL,
+                                    event character varying(20) NOT NULL,
+                                    url text DEFAULT '' NOT NULL,
+                                    user_agent text DEFAULT '' NOT NULL,
+                                    created_at timestamp without time zone
+);
+
+
+--
+-- Name: mail_events_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.mail_events ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.mail_events_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
 INSERT INTO "public"."users"("email","first_name","last_name","password","user_active", "is_admin", "created_at","updated_at")
 VALUES
     (E'admin@example.com',E'Admin',E'User',E'$2a$12$1zGLuYDDNvATh4RA4avbKuheAMpb1svexSzrQm7up.bnpwQHs0jNe',1,1,E'2022-03-14 00:00:00',E'2022-03-14 00:00:00');
@@ -108,6 +244,46 @@ ALTER TABLE ONLY public.users
     ADD CONSTRAINT users_pkey PRIMARY KEY (id);
 
 
+ALTER TABLE ONLY public.mail_queue
+    ADD CONSTRAINT mail_queue_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.mail_dead_letters
+    ADD CONSTRAINT mail_dead_letters_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.mail_log
+    ADD CONSTRAINT mail_log_pkey PRIMARY KEY (id);
+
+
+CREATE INDEX mail_log_user_id_idx ON public.mail_log USING btree (user_id);
+
+
+ALTER TABLE ONLY public.mail_events
+    ADD CONSTRAINT mail_events_pkey PRIMARY KEY (id);
+
+
+CREATE INDEX mail_events_message_id_idx ON public.mail_events USING btree (message_id);
+
+
+ALTER TABLE ONLY public.tokens
+    ADD CONSTRAINT tokens_pkey PRIMARY KEY (id);
+
+
+CREATE UNIQUE INDEX tokens_token_hash_idx ON public.tokens USING btree (token_hash);
+
+
+CREATE INDEX tokens_user_id_purpose_idx ON public.tokens USING btree (user_id, purpose);
+
+
+ALTER TABLE ONLY public.tokens
+    ADD CONSTRAINT tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.mail_log
+    ADD CONSTRAINT mail_log_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
 ALTER TABLE ONLY public.user_plans
     ADD CONSTRAINT user_plans_plan_id_fkey FOREIGN KEY (plan_id) REFERENCES public.plans(id) ON UPDATE RESTRICT ON DELETE CASCADE;
 